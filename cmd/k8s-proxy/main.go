@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/scriptcoffee/k8s-proxy/proxy"
+)
+
+func main() {
+	opts := proxy.DefaultOptions()
+	opts.RegisterFlags(flag.CommandLine)
+	if err := opts.ParseFlags(flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := proxy.New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := server.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+//requireAdmin rejects requests to the admin routes with 403 unless they carry an -admin-token-file
+//token or come from a member of -oidc-admin-group. Without either flag the admin routes are disabled.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdmin(r) {
+			debugf("admin: rejected %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			httpError(w, http.StatusForbidden, "admin access required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//isAdmin reports whether r is authorized for the admin routes
+func (s *Server) isAdmin(r *http.Request) bool {
+	if token := requestToken(r); s.adminTokens != nil && len(token) != 0 && s.adminTokens.valid(token) {
+		return true
+	}
+	if id := requestIdentity(r); len(s.opts.OIDCAdminGroup) != 0 && id != nil {
+		return containsString(id.groups, s.opts.OIDCAdminGroup)
+	}
+	return false
+}
+
+//statusResponse is the JSON body returned by the status endpoint
+type statusResponse struct {
+	Draining bool `json:"draining"`
+	Sessions int  `json:"sessions"`
+}
+
+//serveStatus reports the drain state and remaining session count, so a preStop hook can wait for drain completion
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	draining, count := s.sessions.status()
+	writeJSON(w, http.StatusOK, statusResponse{Draining: draining, Sessions: count})
+}
+
+//serveDrain switches the server into draining mode without exiting: new sessions are
+//rejected with 503 and live ones are asked to disconnect
+func (s *Server) serveDrain(w http.ResponseWriter, r *http.Request) {
+	s.sessions.drain("server draining")
+	s.serveStatus(w, r)
+}
+
+//serveSessions lists the live sessions with their target, user, idle time and byte counts
+func (s *Server) serveSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.sessions.list())
+}
+
+//serveKillSession disconnects a live session, e.g. during an incident
+func (s *Server) serveKillSession(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !s.sessions.kill(id, "session terminated by an administrator") {
+		httpError(w, http.StatusNotFound, "no live session "+id)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
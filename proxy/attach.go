@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+//serveAttach bridges a ws to the container's main process, e.g. a REPL started as PID 1, instead of starting a shell
+func (s *Server) serveAttach(w http.ResponseWriter, r *http.Request) {
+	s.serveSession(w, r, "attach", nil)
+}
+
+//newAttachRequest builds the attach subresource request for a pod, targeting containerName when set.
+//A tty merges stderr into stdout, so stderr is only requested without one, as kubectl attach does.
+func (s *Server) newAttachRequest(client kubernetes.Interface, namespace, podName, containerName string, stdin, tty bool) *rest.Request {
+	req := client.CoreV1().RESTClient().Verb(s.opts.ExecMethod).
+		Namespace(namespace).
+		Resource("pods").
+		Name(podName).
+		SubResource("attach")
+
+	if len(containerName) != 0 {
+		req.Param("container", containerName)
+	}
+	req.Param("stdin", strconv.FormatBool(stdin)).
+		Param("stdout", "true").
+		Param("stderr", strconv.FormatBool(!tty)).
+		Param("tty", strconv.FormatBool(tty))
+
+	debugf("attach request: namespace=%s pod=%s container=%q stdin=%t stdout=true stderr=%t tty=%t method=%s url=%s",
+		namespace, podName, containerName, stdin, !tty, tty, s.opts.ExecMethod, redactURL(req.URL()))
+	return req
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Time allowed for the audit webhook to accept a record.
+	auditWebhookTimeout = 5 * time.Second
+
+	// Records waiting for the audit webhook before new ones are dropped.
+	auditQueueSize = 1024
+)
+
+//AuditRecord describes one session for the audit trail, as written to -audit-log and the Audit option
+type AuditRecord struct {
+	Session    string    `json:"session"`
+	Endpoint   string    `json:"endpoint"`
+	Cluster    string    `json:"cluster,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Groups     []string  `json:"groups,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Namespace  string    `json:"namespace"`
+	Pod        string    `json:"pod"`
+	Container  string    `json:"container,omitempty"`
+	Command    []string  `json:"command,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Reason     string    `json:"reason"`
+	BytesIn    int64     `json:"bytesIn"`
+	BytesOut   int64     `json:"bytesOut"`
+	Recording  string    `json:"recording,omitempty"`
+}
+
+//auditLog writes audit records to -audit-log and posts them to -audit-webhook
+type auditLog struct {
+	mu      sync.Mutex
+	out     io.Writer
+	webhook string
+	queue   chan []byte
+}
+
+//setupAudit opens the audit destinations, appending to path ("-" for stdout) and posting to webhook until
+//the Server is closed. The audit trail is nil when neither is set.
+func (s *Server) setupAudit(path, webhook string) (*auditLog, error) {
+	if len(path) == 0 && len(webhook) == 0 {
+		return nil, nil
+	}
+
+	//A dry run only checks the log could be created, without creating it or starting the poster
+	if s.opts.ValidateConfig {
+		return nil, checkAuditPath(path)
+	}
+
+	a := &auditLog{webhook: webhook}
+	switch path {
+	case "":
+	case "-":
+		a.out = os.Stdout
+	default:
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %v", err)
+		}
+		a.out = f
+	}
+
+	//Posting happens in the background so a slow webhook never holds up a session
+	if len(webhook) != 0 {
+		a.queue = make(chan []byte, auditQueueSize)
+		go a.post(s.ctx)
+	}
+	return a, nil
+}
+
+//checkAuditPath reports whether path could be opened as the audit log, by checking its directory
+func checkAuditPath(path string) error {
+	if len(path) == 0 || path == "-" {
+		return nil
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("opening audit log: %s is a directory", path)
+	}
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("opening audit log: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("opening audit log: %s is not a directory", filepath.Dir(path))
+	}
+	return nil
+}
+
+//record writes rec as one JSON line and queues it for the webhook
+func (a *auditLog) record(rec *AuditRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		errorf("audit: encoding record: %v", err)
+		return
+	}
+
+	if a.out != nil {
+		a.mu.Lock()
+		_, err := a.out.Write(append(data, '\n'))
+		a.mu.Unlock()
+		if err != nil {
+			errorf("audit: writing record: %v", err)
+		}
+	}
+
+	if a.queue != nil {
+		select {
+		case a.queue <- data:
+		default:
+			errorf("audit: webhook queue full, dropping record of session %s", rec.Session)
+		}
+	}
+}
+
+//post sends queued records to the webhook one at a time until ctx is done
+func (a *auditLog) post(ctx context.Context) {
+	client := &http.Client{Timeout: auditWebhookTimeout}
+	for {
+		var data []byte
+		select {
+		case data = <-a.queue:
+		case <-ctx.Done():
+			return
+		}
+		reqCtx, cancel := context.WithTimeout(context.Background(), auditWebhookTimeout)
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, a.webhook, bytes.NewReader(data))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			var resp *http.Response
+			resp, err = client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 300 {
+					err = fmt.Errorf("webhook returned %s", resp.Status)
+				}
+			}
+		}
+		cancel()
+		if err != nil {
+			errorf("audit: posting record: %v", err)
+		}
+	}
+}
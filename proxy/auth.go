@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+//Paths served without a token so probes keep working
+var unauthenticatedPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+//tokenStore holds the valid bearer tokens read from -auth-token-file
+type tokenStore struct {
+	mu     sync.RWMutex
+	path   string
+	tokens [][]byte
+}
+
+//newTokenStore loads the token file
+func newTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//watch reloads the token file whenever the process receives SIGHUP, until ctx is done
+func (s *tokenStore) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+			if err := s.load(); err != nil {
+				errorf("auth: keeping previous tokens, reload failed: %v", err)
+				continue
+			}
+			infof("auth: reloaded %s", s.path)
+		}
+	}()
+}
+
+//load reads one token per line, skipping blank lines and # comments
+func (s *tokenStore) load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var tokens [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, []byte(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.tokens = tokens
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *tokenStore) valid(token string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	valid := false
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(t, []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+//requestToken returns the bearer token of the Authorization header, or the token query
+//param since browsers can't set headers on ws upgrades
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return auth[len("Bearer "):]
+	}
+	return r.URL.Query().Get("token")
+}
+
+//requireToken rejects requests without a valid token with 401, before any upgrade happens
+func requireToken(s, admin *tokenStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		//Admin tokens authenticate too, the admin routes check them again
+		token := requestToken(r)
+		if len(token) == 0 || !s.valid(token) && (admin == nil || !admin.valid(token)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//requireHook rejects requests the Authenticate option fails with 401, before any upgrade happens, and
+//stores the user and groups it returns for the others in the request context
+func requireHook(hook func(r *http.Request) (string, []string, error), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, groups, err := hook(r)
+		if err != nil {
+			debugf("auth: rejected request from %s: %v", r.RemoteAddr, err)
+			httpError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, &identity{user: user, groups: groups})))
+	})
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Longest deny reason passed on to clients, so it fits in a ws close frame.
+const authzMaxReason = 100
+
+//authzInput describes a session about to start to the -authz-webhook-url
+type authzInput struct {
+	User       string              `json:"user,omitempty"`
+	Groups     []string            `json:"groups,omitempty"`
+	Cluster    string              `json:"cluster,omitempty"`
+	Endpoint   string              `json:"endpoint"`
+	Namespace  string              `json:"namespace"`
+	Pod        string              `json:"pod"`
+	Container  string              `json:"container,omitempty"`
+	Command    []string            `json:"command,omitempty"`
+	Env        []string            `json:"env,omitempty"`
+	Cwd        string              `json:"cwd,omitempty"`
+	Image      string              `json:"image,omitempty"`
+	Profile    string              `json:"profile,omitempty"`
+	RemoteAddr string              `json:"remoteAddr"`
+	Params     map[string][]string `json:"params,omitempty"`
+	Time       time.Time           `json:"time"`
+}
+
+//authzDecision is the webhook's answer, the result of an OPA policy such as data.k8sproxy.authz
+type authzDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+//authorize asks the -authz-webhook-url whether the session may start, returning the deny reason as
+//an error. Errors reaching the webhook deny the session too. Without a webhook everything is allowed.
+func (s *Server) authorize(r *http.Request, endpoint, namespace, podName, containerName string, command []string) error {
+	return s.authorizeInput(r, authzInput{
+		Endpoint:  endpoint,
+		Namespace: namespace,
+		Pod:       podName,
+		Container: containerName,
+		Command:   command,
+	})
+}
+
+//authorizeInput is authorize for the session input describes, filling in the client of r
+func (s *Server) authorizeInput(r *http.Request, input authzInput) error {
+	if len(s.opts.AuthzWebhookURL) == 0 {
+		return nil
+	}
+
+	//The query carries what the rules may need beyond the target, e.g. an approved ticket
+	params := r.URL.Query()
+	params.Del("token")
+	input.User, input.Groups = s.requestUserInfo(r)
+	input.Cluster = s.requestCluster(r).name
+	input.RemoteAddr = r.RemoteAddr
+	input.Params = params
+	input.Time = time.Now()
+
+	ctx, span := tracer.Start(r.Context(), "authorize")
+	decision, err := s.callAuthzWebhook(ctx, input)
+	if err == nil {
+		span.SetAttributes(attribute.Bool("authz.allow", decision.Allow))
+	}
+	endSpan(span, err)
+	if err != nil {
+		errorf("authz: webhook: %v", err)
+		authzDecisions.WithLabelValues("error").Inc()
+		return errors.New("authz: authorization unavailable")
+	}
+	if !decision.Allow {
+		authzDecisions.WithLabelValues("deny").Inc()
+		reason := decision.Reason
+		if len(reason) == 0 {
+			reason = "denied"
+		}
+		if len(reason) > authzMaxReason {
+			reason = reason[:authzMaxReason]
+		}
+		return fmt.Errorf("authz: %s", reason)
+	}
+	authzDecisions.WithLabelValues("allow").Inc()
+	return nil
+}
+
+//callAuthzWebhook posts {"input": input} as OPA's data API expects and reads {"result": decision}.
+//A bare boolean result is accepted as well.
+func (s *Server) callAuthzWebhook(ctx context.Context, input authzInput) (*authzDecision, error) {
+	body, err := json.Marshal(struct {
+		Input authzInput `json:"input"`
+	}{input})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opts.AuthzWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.AuthzWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s: %s", s.opts.AuthzWebhookURL, resp.Status)
+	}
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, err
+	}
+
+	//OPA leaves result out when the policy is undefined for the input, which denies
+	decision := &authzDecision{}
+	var allow bool
+	switch {
+	case len(answer.Result) == 0:
+	case json.Unmarshal(answer.Result, &allow) == nil:
+		decision.Allow = allow
+	default:
+		if err := json.Unmarshal(answer.Result, decision); err != nil {
+			return nil, fmt.Errorf("decoding result: %v", err)
+		}
+	}
+	return decision, nil
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+//cluster is an API server sessions can be routed to
+type cluster struct {
+	//Kubeconfig context the cluster was loaded from, empty for the default cluster
+	name      string
+	config    *rest.Config
+	clientset *kubernetes.Clientset
+}
+
+//clusterSet holds the clusters a Server routes sessions to. Reloading the kubeconfig replaces them as a whole.
+type clusterSet struct {
+	mu sync.RWMutex
+
+	//Cluster of requests naming none
+	def *cluster
+
+	//Clusters selectable with the /clusters/{cluster} path prefix or the cluster param, loaded from -clusters
+	named map[string]*cluster
+}
+
+//set serves new sessions from def and named. Sessions already running keep the config and
+//clientset they started with.
+func (c *clusterSet) set(def *cluster, named map[string]*cluster) {
+	c.mu.Lock()
+	c.def = def
+	c.named = named
+	c.mu.Unlock()
+}
+
+//get returns the -clusters context called name
+func (c *clusterSet) get(name string) (*cluster, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cl, ok := c.named[name]
+	return cl, ok
+}
+
+//defaultCluster returns the cluster of requests naming none
+func (c *clusterSet) defaultCluster() *cluster {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.def
+}
+
+//clusterKey is the request context key holding the cluster a request is routed to
+type clusterKey struct{}
+
+//loadClusters loads a cluster for each kubeconfig context in the comma separated list, or every context for "*"
+func loadClusters(kubeconfig, list string) (map[string]*cluster, error) {
+	named := make(map[string]*cluster)
+	if len(strings.TrimSpace(list)) == 0 {
+		return named, nil
+	}
+
+	raw, err := clientcmd.LoadFromFile(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("loading kubeconfig %q: %v", kubeconfig, err)
+	}
+
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "*":
+			for context := range raw.Contexts {
+				names = append(names, context)
+			}
+		case len(name) != 0:
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := raw.Contexts[name]; !ok {
+			return nil, fmt.Errorf("no context %q in kubeconfig %q", name, kubeconfig)
+		}
+		cfg, err := clientcmd.NewNonInteractiveClientConfig(*raw, name, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("loading context %q: %v", name, err)
+		}
+		cs, err := kubernetes.NewForConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("loading context %q: %v", name, err)
+		}
+		named[name] = &cluster{name: name, config: cfg, clientset: cs}
+	}
+	return named, nil
+}
+
+//routeCluster resolves the cluster named by the {cluster} path variable or the cluster param,
+//rejecting unknown ones with 404 before the handler runs. The cluster is pinned for the whole
+//request, so a kubeconfig reload can't switch it halfway through a session's setup.
+func (s *Server) routeCluster(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["cluster"]
+		if len(name) == 0 {
+			name = r.URL.Query().Get("cluster")
+		}
+
+		c, ok := s.clusters.defaultCluster(), true
+		if len(name) != 0 {
+			c, ok = s.clusters.get(name)
+		}
+		if !ok {
+			httpError(w, http.StatusNotFound, fmt.Sprintf("unknown cluster %q", name))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clusterKey{}, c)))
+	})
+}
+
+//requestCluster returns the cluster r is routed to
+func (s *Server) requestCluster(r *http.Request) *cluster {
+	if c, ok := r.Context().Value(clusterKey{}).(*cluster); ok {
+		return c
+	}
+	return s.clusters.defaultCluster()
+}
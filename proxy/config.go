@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+//applyConfigFile sets every flag of fs not given on the command line or in the environment from the YAML
+//or JSON file at path, whose keys are flag names, e.g. read-timeout: 30m. Lists are joined with commas
+//for the flags taking comma separated values. Unknown keys are errors.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	//Sorted so the first error reported doesn't depend on map order
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == "config" || name == "validate-config" {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, configValue(values[name])); err != nil {
+			return fmt.Errorf("%s: invalid %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+//configValue formats a config file value as it would be given on the command line
+func configValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, configValue(item))
+		}
+		return strings.Join(items, ",")
+	case float64:
+		//YAML numbers arrive as floats, integers must not be printed as 1e+06
+		if v == float64(int64(v)) {
+			return fmt.Sprint(int64(v))
+		}
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotation kubectl uses to pick the container when none is specified.
+const defaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+//defaultContainer picks the container to target when the client didn't name one:
+//the default-container annotation if set, otherwise the only container of the pod
+func defaultContainer(ctx context.Context, client kubernetes.Interface, namespace, podName string) (string, error) {
+	pod, err := client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	if name := pod.Annotations[defaultContainerAnnotation]; len(name) != 0 {
+		return name, nil
+	}
+	if len(pod.Spec.Containers) == 1 {
+		return pod.Spec.Containers[0].Name, nil
+	}
+	return "", apierrors.NewBadRequest(fmt.Sprintf("pod %s/%s has %d containers, a container must be specified", namespace, podName, len(pod.Spec.Containers)))
+}
+
+//statusForError maps a Kubernetes API error to the HTTP status returned to the client
+func statusForError(err error) int {
+	switch {
+	case apierrors.IsBadRequest(err):
+		return http.StatusBadRequest
+	case apierrors.IsNotFound(err):
+		return http.StatusNotFound
+	case apierrors.IsForbidden(err):
+		return http.StatusForbidden
+	case apierrors.IsUnauthorized(err):
+		return http.StatusUnauthorized
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+//containerInfo describes one container of a pod in the containers endpoint response
+type containerInfo struct {
+	Name    string `json:"name"`
+	Image   string `json:"image"`
+	Init    bool   `json:"init"`
+	Ready   bool   `json:"ready"`
+	Running bool   `json:"running"`
+}
+
+//serveContainers lists the init and regular containers of a pod so a client can pick one to exec into
+func (s *Server) serveContainers(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	namespace := params["namespace"]
+	podName := params["podName"]
+
+	client, err := s.requestClient(r)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	pod, err := client.CoreV1().Pods(namespace).Get(r.Context(), podName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		httpError(w, http.StatusNotFound, fmt.Sprintf("pod %s/%s not found", namespace, podName))
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	containers := make([]containerInfo, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	containers = appendContainers(containers, pod.Spec.InitContainers, pod.Status.InitContainerStatuses, true)
+	containers = appendContainers(containers, pod.Spec.Containers, pod.Status.ContainerStatuses, false)
+	writeJSON(w, http.StatusOK, containers)
+}
+
+func appendContainers(dst []containerInfo, specs []corev1.Container, statuses []corev1.ContainerStatus, init bool) []containerInfo {
+	byName := make(map[string]corev1.ContainerStatus, len(statuses))
+	for _, status := range statuses {
+		byName[status.Name] = status
+	}
+
+	for _, c := range specs {
+		status := byName[c.Name]
+		dst = append(dst, containerInfo{
+			Name:    c.Name,
+			Image:   c.Image,
+			Init:    init,
+			Ready:   status.Ready,
+			Running: status.State.Running != nil,
+		})
+	}
+	return dst
+}
@@ -0,0 +1,373 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Bytes of tar stderr kept to explain a failed copy.
+const cpStderrLimit = 4096
+
+//cpTarget holds the validated parameters of a copy request
+type cpTarget struct {
+	namespace     string
+	podName       string
+	containerName string
+	path          string
+}
+
+//parseCpTarget validates the pod and the absolute container path of a copy, resolving the default container
+func (s *Server) parseCpTarget(r *http.Request) (*cpTarget, int, error) {
+	params := mux.Vars(r)
+	vals := r.URL.Query()
+	t := &cpTarget{
+		namespace:     params["namespace"],
+		podName:       params["podName"],
+		containerName: vals.Get("container"),
+		path:          vals.Get("path"),
+	}
+	if err := validateTarget(t.namespace, t.podName); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if !path.IsAbs(t.path) {
+		return nil, http.StatusBadRequest, fmt.Errorf("path %q must be absolute", t.path)
+	}
+	t.path = path.Clean(t.path)
+
+	if len(t.containerName) == 0 {
+		client, err := s.requestClient(r)
+		if err == nil {
+			t.containerName, err = defaultContainer(r.Context(), client, t.namespace, t.podName)
+		}
+		if err != nil {
+			return nil, statusForError(err), err
+		}
+	}
+	return t, 0, nil
+}
+
+//cpSession is the connection of a copy in the sessions registry. Closing it cancels tar.
+type cpSession struct {
+	cancel context.CancelFunc
+
+	//Yields the outcome once tar has exited, with its stderr as the error message
+	done chan error
+}
+
+func (s *cpSession) Close() error {
+	s.cancel()
+	return nil
+}
+
+//startTar runs tar with args in the container, checked against -allowed-commands, the policy and the
+//authz webhook like any exec command, and registers it as a session described by logger until the
+//caller removes it. It returns the HTTP status to reject the copy with when it can't start.
+func (s *Server) startTar(r *http.Request, t *cpTarget, logger *sessionLogger, args []string, stdin io.Reader, stdout io.Writer) (*cpSession, int, error) {
+	command, err := s.execCommand(append([]string{"tar"}, args...))
+	if err == nil {
+		err = s.policy.check(r.Context(), s.requestCluster(r).clientset, t.namespace, t.podName, t.containerName, command)
+	}
+	if err == nil {
+		err = s.authorize(r, "cp", t.namespace, t.podName, t.containerName, command)
+	}
+	if err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	req := s.newExecRequest(s.requestCluster(r).clientset, t.namespace, t.podName, t.containerName, command, stdin != nil, false)
+	executor, err := s.newExecutor(s.requestConfig(r), s.opts.ExecMethod, req.URL())
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	logger.record.Command = command
+	ctx, cancel := context.WithCancel(r.Context())
+	cp := &cpSession{cancel: cancel, done: make(chan error, 1)}
+	if !s.sessions.add(cp, logger) {
+		cancel()
+		return nil, http.StatusServiceUnavailable, errors.New("server draining")
+	}
+
+	go func() {
+		defer cancel()
+		stderr := &limitedBuffer{max: cpStderrLimit}
+		err := executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+			Stdin:  stdin,
+			Stdout: stdout,
+			Stderr: stderr,
+		})
+		//Writers blocked on stdin would otherwise wait forever once tar stopped reading
+		if c, ok := stdin.(io.Closer); ok {
+			c.Close()
+		}
+		if err != nil && stderr.Len() != 0 {
+			err = errors.New(strings.TrimSpace(stderr.String()))
+		}
+		cp.done <- err
+	}()
+	return cp, 0, nil
+}
+
+//serveCopyFrom downloads path from the container. A regular file is sent as is with its size as
+//Content-Length, anything else, or any path with format=tar, as a tar archive.
+func (s *Server) serveCopyFrom(w http.ResponseWriter, r *http.Request) {
+	release, ok := s.admitSession(&responseGuard{ResponseWriter: w}, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	t, status, err := s.parseCpTarget(r)
+	if err != nil {
+		httpError(w, status, err.Error())
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "tar" && format != "raw" {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("invalid format %q, must be raw or tar", format))
+		return
+	}
+
+	logger := s.newSessionLogger(r, "cp", t.namespace, t.podName, t.containerName)
+	dir, base := path.Split(t.path)
+	if len(base) == 0 {
+		//The root directory
+		dir, base = "/", "."
+	}
+
+	pr, pw := io.Pipe()
+	cp, status, err := s.startTar(r, t, logger, []string{"cf", "-", "-C", dir, base}, nil, pw)
+	if err != nil {
+		logger.ended(fmt.Sprintf("rejected: %v", err))
+		httpError(w, status, err.Error())
+		return
+	}
+	defer s.sessions.remove(cp)
+	go func() {
+		pw.CloseWithError(<-cp.done)
+	}()
+	//Unblocks tar if the client goes away mid download
+	defer pr.Close()
+
+	//The first header tells a file from a directory; keep its bytes to replay them in tar mode
+	head := &replayReader{r: pr}
+	tr := tar.NewReader(head)
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		err = fmt.Errorf("%s: no such file or directory", t.path)
+	}
+	if err != nil {
+		logger.ended(fmt.Sprintf("rejected: %v", err))
+		cpStatus := http.StatusBadGateway
+		if notFoundPattern.MatchString(err.Error()) {
+			cpStatus = http.StatusNotFound
+		}
+		httpError(w, cpStatus, err.Error())
+		return
+	}
+
+	logger.infof("download started path=%s format=%s", t.path, format)
+	var body io.Reader
+	if hdr.Typeflag == tar.TypeReg && format != "tar" {
+		head.stop()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(hdr.Size, 10))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(hdr.Name)))
+		body = tr
+	} else {
+		if format == "raw" {
+			logger.ended("rejected: not a regular file")
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("%s is not a regular file, use format=tar", t.path))
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(t.path)+".tar"))
+		body = io.MultiReader(bytes.NewReader(head.replay()), pr)
+	}
+
+	n, err := io.Copy(w, body)
+	logger.countOut(int(n))
+	if err != nil {
+		logger.errorf("download: %v", err)
+		logger.ended("download failed")
+		//Abort the response so the client sees a truncated transfer rather than a complete one
+		panic(http.ErrAbortHandler)
+	}
+	logger.ended("download complete")
+}
+
+//cpFile describes one uploaded file in the upload response
+type cpFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+//serveCopyTo uploads the files of a multipart form into the directory path of the container.
+//Parts are spooled to disk one at a time, since tar needs each file's size before its content.
+func (s *Server) serveCopyTo(w http.ResponseWriter, r *http.Request) {
+	release, ok := s.admitSession(&responseGuard{ResponseWriter: w}, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	t, status, err := s.parseCpTarget(r)
+	if err != nil {
+		httpError(w, status, err.Error())
+		return
+	}
+	if s.opts.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxUploadSize)
+	}
+	parts, err := r.MultipartReader()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logger := s.newSessionLogger(r, "cp", t.namespace, t.podName, t.containerName)
+
+	pr, pw := io.Pipe()
+	cp, status, err := s.startTar(r, t, logger, []string{"xf", "-", "-C", t.path}, pr, io.Discard)
+	if err != nil {
+		logger.ended(fmt.Sprintf("rejected: %v", err))
+		httpError(w, status, err.Error())
+		return
+	}
+	defer s.sessions.remove(cp)
+	logger.infof("upload started path=%s", t.path)
+
+	files, writeErr := writeTar(pw, parts, logger)
+	pw.CloseWithError(writeErr)
+	//When tar failed first its error explains the write error
+	tarErr := <-cp.done
+	switch {
+	case tarErr != nil:
+		err = tarErr
+	case writeErr != nil:
+		err = writeErr
+	}
+	if err != nil {
+		logger.errorf("upload: %v", err)
+		logger.ended("upload failed")
+		httpError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	logger.ended(fmt.Sprintf("upload complete files=%d", len(files)))
+	writeJSON(w, http.StatusOK, files)
+}
+
+//writeTar writes every file part of the form to w as a tar archive, returning what was written
+func writeTar(w io.Writer, parts *multipart.Reader, logger *sessionLogger) ([]cpFile, error) {
+	tw := tar.NewWriter(w)
+	files := []cpFile{}
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return files, err
+		}
+		//Only the base name is kept so uploads can't escape the target directory
+		name := path.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+		if len(part.FileName()) == 0 || name == "." || name == ".." || name == "/" {
+			continue
+		}
+
+		size, err := writeTarFile(tw, name, part)
+		if err != nil {
+			return files, fmt.Errorf("%s: %v", name, err)
+		}
+		logger.countIn(int(size))
+		logger.debugf("uploaded %s bytes=%d", name, size)
+		files = append(files, cpFile{Name: name, Size: size})
+	}
+	if len(files) == 0 {
+		return files, errors.New("no files in the upload")
+	}
+	return files, tw.Close()
+}
+
+//writeTarFile spools src to a temporary file to learn its size, then writes it to tw as name
+func writeTarFile(tw *tar.Writer, name string, src io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp("", "k8s-proxy-cp-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, src)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size, ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(tw, tmp)
+	return size, err
+}
+
+//replayReader records what is read from r until stop is called, so it can be read again
+type replayReader struct {
+	r       io.Reader
+	buf     bytes.Buffer
+	stopped bool
+}
+
+func (rr *replayReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if !rr.stopped {
+		rr.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+func (rr *replayReader) stop() {
+	rr.stopped = true
+	rr.buf.Reset()
+}
+
+//replay returns what was read so far
+func (rr *replayReader) replay() []byte {
+	return rr.buf.Bytes()
+}
+
+//limitedBuffer keeps the first max bytes written to it and discards the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
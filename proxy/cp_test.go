@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+//tarExecutor stands for a container whose tar sends an archive of one file, or never answers while
+//stalled, until ctx is done
+type tarExecutor struct {
+	stalled bool
+}
+
+func (e tarExecutor) Stream(options remotecommand.StreamOptions) error {
+	return e.StreamWithContext(context.Background(), options)
+}
+
+func (e tarExecutor) StreamWithContext(ctx context.Context, options remotecommand.StreamOptions) error {
+	if e.stalled {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	tw := tar.NewWriter(options.Stdout)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "core", Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	return tw.Close()
+}
+
+//newCpTestServer is newTestProxy with containers answering tar like e
+func newCpTestServer(t *testing.T, e tarExecutor, configure func(o *Options)) (*Server, string) {
+	t.Helper()
+	executorBackends["tar"] = func(*rest.Config, string, *url.URL) (remotecommand.Executor, error) {
+		return e, nil
+	}
+	t.Cleanup(func() { delete(executorBackends, "tar") })
+	s, ts := newTestProxy(t, func(o *Options) {
+		o.ExecBackend = "tar"
+		if configure != nil {
+			configure(o)
+		}
+	})
+	return s, ts.URL + "/api/v1/namespaces/default/pods/web-0/cp?container=app&path=/tmp/core"
+}
+
+//download requests u with header, returning the status and body
+func download(t *testing.T, u string, header http.Header) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestCopyChecksAllowedCommands(t *testing.T) {
+	for _, test := range []struct {
+		allowed string
+		status  int
+	}{
+		{"", http.StatusOK},
+		{"tar", http.StatusOK},
+		{"/bin/sh", http.StatusForbidden},
+	} {
+		_, u := newCpTestServer(t, tarExecutor{}, func(o *Options) { o.AllowedCommands = test.allowed })
+		status, body := download(t, u, nil)
+		if status != test.status {
+			t.Errorf("-allowed-commands %q: got status %d, want %d", test.allowed, status, test.status)
+		}
+		if status == http.StatusOK && body != "hello" {
+			t.Errorf("-allowed-commands %q: got %q, want the file", test.allowed, body)
+		}
+	}
+}
+
+func TestCopyIsAdmitted(t *testing.T) {
+	s, u := newCpTestServer(t, tarExecutor{}, func(o *Options) {
+		o.AllowedOrigins = "https://good.example"
+		o.MaxSessions = 1
+	})
+	if status, _ := download(t, u, http.Header{"Origin": {"https://evil.example"}}); status != http.StatusForbidden {
+		t.Errorf("bad origin: got status %d, want 403", status)
+	}
+
+	//Another client holds the only session slot
+	if err := s.sessions.reserve("192.0.2.1", ""); err != nil {
+		t.Fatal(err)
+	}
+	status, _ := download(t, u, nil)
+	s.sessions.release("192.0.2.1", "")
+	if status != http.StatusTooManyRequests {
+		t.Errorf("over -max-sessions: got status %d, want 429", status)
+	}
+}
+
+func TestCopyListedAndKilled(t *testing.T) {
+	s, u := newCpTestServer(t, tarExecutor{stalled: true}, nil)
+	done := make(chan int, 1)
+	go func() {
+		status, _ := download(t, u, nil)
+		done <- status
+	}()
+
+	var listed []sessionInfo
+	for deadline := time.Now().Add(5 * time.Second); len(listed) == 0; time.Sleep(10 * time.Millisecond) {
+		listed = s.sessions.list()
+		if time.Now().After(deadline) {
+			t.Fatal("the copy wasn't listed as a session")
+		}
+	}
+	if listed[0].Endpoint != "cp" || len(listed[0].Command) == 0 || listed[0].Command[0] != "tar" {
+		t.Fatalf("got sessions %+v, want the cp session running tar", listed)
+	}
+
+	s.sessions.kill(listed[0].ID, "test over")
+	select {
+	case status := <-done:
+		if status != http.StatusBadGateway {
+			t.Errorf("killed copy: got status %d, want 502", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the killed copy kept running")
+	}
+}
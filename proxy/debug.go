@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Time allowed for a debug container to pull its image and start.
+	debugStartTimeout = 2 * time.Minute
+
+	// Interval between checks of whether a debug container is running.
+	debugPollInterval = time.Second
+
+	// Profile used when the client doesn't pick one, as kubectl debug does.
+	defaultDebugProfile = "general"
+)
+
+//parseDebugFlags parses the comma separated -debug-images and -debug-profiles lists
+func parseDebugFlags(images, profiles string) ([]string, map[string]bool, error) {
+	var globs []string
+	for _, glob := range strings.Split(images, ",") {
+		glob = strings.TrimSpace(glob)
+		if len(glob) == 0 {
+			continue
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, nil, fmt.Errorf("invalid -debug-images glob %q: %v", glob, err)
+		}
+		globs = append(globs, glob)
+	}
+
+	allowed := make(map[string]bool)
+	for _, profile := range strings.Split(profiles, ",") {
+		profile = strings.TrimSpace(profile)
+		if len(profile) == 0 {
+			continue
+		}
+		if _, err := debugSecurityContext(profile); err != nil {
+			return nil, nil, fmt.Errorf("invalid -debug-profiles: %v", err)
+		}
+		allowed[profile] = true
+	}
+	return globs, allowed, nil
+}
+
+//debugSecurityContext returns the security context kubectl debug sets on ephemeral containers for profile
+func debugSecurityContext(profile string) (*corev1.SecurityContext, error) {
+	switch profile {
+	case "legacy", "baseline":
+		return nil, nil
+	case "general":
+		return &corev1.SecurityContext{
+			Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_PTRACE"}},
+		}, nil
+	case "restricted":
+		nonRoot, escalation := true, false
+		return &corev1.SecurityContext{
+			RunAsNonRoot:             &nonRoot,
+			AllowPrivilegeEscalation: &escalation,
+			Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+			SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+		}, nil
+	case "netadmin":
+		return &corev1.SecurityContext{
+			Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN", "NET_RAW"}},
+		}, nil
+	case "sysadmin":
+		privileged := true
+		return &corev1.SecurityContext{Privileged: &privileged}, nil
+	}
+	return nil, fmt.Errorf("unknown debug profile %q", profile)
+}
+
+//debugOptions holds the validated parameters of a debug request
+type debugOptions struct {
+	namespace string
+	podName   string
+	image     string
+	target    string
+	profile   string
+	command   []string
+	tty       bool
+}
+
+//parseDebugOptions validates the debug request without writing to the response
+func (s *Server) parseDebugOptions(r *http.Request) (*debugOptions, error) {
+	params := mux.Vars(r)
+	vals := r.URL.Query()
+	opts := &debugOptions{
+		namespace: params["namespace"],
+		podName:   params["podName"],
+		image:     vals.Get("image"),
+		target:    vals.Get("target"),
+		profile:   vals.Get("profile"),
+		command:   vals["command"],
+		tty:       vals.Get("tty") != "false",
+	}
+	if err := validateTarget(opts.namespace, opts.podName); err != nil {
+		return nil, err
+	}
+
+	if len(opts.image) == 0 {
+		return nil, fmt.Errorf("image is required")
+	}
+	if !matchAny(s.debugImageGlobs, opts.image) {
+		return nil, fmt.Errorf("image %s is not allowed for debug containers", opts.image)
+	}
+
+	if len(opts.profile) == 0 {
+		opts.profile = defaultDebugProfile
+	}
+	if !s.allowedDebugProfiles[opts.profile] {
+		return nil, fmt.Errorf("debug profile %q is not allowed", opts.profile)
+	}
+	return opts, nil
+}
+
+//serveDebug adds an ephemeral debug container to the pod, as kubectl debug does, and attaches the ws to it
+//once it runs. This reaches pods whose images have no shell at all. Containers can't be removed once
+//added, so the request is admitted, checked and authorized before anything is asked of the API server.
+func (s *Server) serveDebug(w http.ResponseWriter, r *http.Request) {
+	if len(s.debugImageGlobs) == 0 {
+		httpError(w, http.StatusNotFound, "debug containers are disabled")
+		return
+	}
+	release, ok := s.admitSession(&responseGuard{ResponseWriter: w}, r)
+	if !ok {
+		return
+	}
+	//Handed on to the attached session once the container runs
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+
+	opts, err := s.parseDebugOptions(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//The container being debugged is what the policy restricts, the webhook also sees the image and profile
+	err = s.debugCommand(opts.command)
+	if err == nil {
+		err = s.policy.check(r.Context(), s.requestCluster(r).clientset, opts.namespace, opts.podName, opts.target, opts.command)
+	}
+	if err == nil {
+		err = s.authorizeInput(r, authzInput{
+			Endpoint:  "debug",
+			Namespace: opts.namespace,
+			Pod:       opts.podName,
+			Container: opts.target,
+			Command:   opts.command,
+			Image:     opts.image,
+			Profile:   opts.profile,
+		})
+	}
+	if err != nil {
+		httpError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	client, err := s.requestClient(r)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), debugStartTimeout)
+	defer cancel()
+
+	name, err := addDebugContainer(ctx, client, opts)
+	if err != nil {
+		httpError(w, statusForError(err), err.Error())
+		return
+	}
+	infof("debug container %s added to %s/%s image=%s target=%q profile=%s remote=%s", name, opts.namespace, opts.podName, opts.image, opts.target, opts.profile, r.RemoteAddr)
+
+	if err := waitForDebugContainer(ctx, client, opts.namespace, opts.podName, name); err != nil {
+		httpError(w, http.StatusGatewayTimeout, err.Error())
+		return
+	}
+
+	//Attach to the new container; its command was set on creation
+	vals := r.URL.Query()
+	vals.Set("container", name)
+	vals.Set("stdin", "true")
+	vals.Set("tty", strconv.FormatBool(opts.tty))
+	vals.Del("command")
+	r.URL.RawQuery = vals.Encode()
+	admitted := release
+	release = nil
+	s.serveSession(w, r, "debug", admitted)
+}
+
+//debugCommand checks the command of a debug container against -allowed-commands. Without a command the
+//container runs its image's entrypoint, which isn't known here, so that is only allowed when any binary is.
+func (s *Server) debugCommand(command []string) error {
+	if len(command) == 0 {
+		if len(s.allowedCommands) != 0 {
+			return errors.New("debug containers need a command in the allowed commands")
+		}
+		return nil
+	}
+	_, err := s.execCommand(command)
+	return err
+}
+
+//addDebugContainer adds an ephemeral container for opts to the pod, returning its name
+func addDebugContainer(ctx context.Context, client kubernetes.Interface, opts *debugOptions) (string, error) {
+	pods := client.CoreV1().Pods(opts.namespace)
+	pod, err := pods.Get(ctx, opts.podName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	securityContext, err := debugSecurityContext(opts.profile)
+	if err != nil {
+		return "", err
+	}
+	name := "debugger-" + newSessionID()[:5]
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:                     name,
+			Image:                    opts.image,
+			Command:                  opts.command,
+			ImagePullPolicy:          corev1.PullIfNotPresent,
+			Stdin:                    true,
+			TTY:                      opts.tty,
+			TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+			SecurityContext:          securityContext,
+		},
+		TargetContainerName: opts.target,
+	})
+
+	if _, err := pods.UpdateEphemeralContainers(ctx, opts.podName, pod, metav1.UpdateOptions{}); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+//waitForDebugContainer polls the pod until the ephemeral container name runs, failing early when it
+//terminated or its image can't be pulled
+func waitForDebugContainer(ctx context.Context, client kubernetes.Interface, namespace, podName, name string) error {
+	ticker := time.NewTicker(debugPollInterval)
+	defer ticker.Stop()
+
+	for {
+		pod, err := client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, status := range pod.Status.EphemeralContainerStatuses {
+			if status.Name != name {
+				continue
+			}
+			switch state := status.State; {
+			case state.Running != nil:
+				return nil
+			case state.Terminated != nil:
+				return fmt.Errorf("debug container %s terminated: %s", name, state.Terminated.Reason)
+			case state.Waiting != nil && debugStartFailed(state.Waiting.Reason):
+				return fmt.Errorf("debug container %s not starting: %s %s", name, state.Waiting.Reason, state.Waiting.Message)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("debug container %s not running within %s", name, debugStartTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+//debugStartFailed reports whether a waiting reason such as ErrImagePull or ImagePullBackOff means the
+//container won't start without intervention
+func debugStartFailed(reason string) bool {
+	return strings.Contains(reason, "Err") || strings.HasSuffix(reason, "BackOff") || reason == "InvalidImageName"
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+//newDebugTestServer is newTestProxy with debug containers enabled, returning the debug URL of web-0 and
+//the number of requests that reached the API server
+func newDebugTestServer(t *testing.T, configure func(o *Options)) (*Server, string, *int64) {
+	t.Helper()
+	var apiRequests int64
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&apiRequests, 1)
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	t.Cleanup(api.Close)
+	s, ts := newTestProxy(t, func(o *Options) {
+		o.RESTConfig = &rest.Config{Host: api.URL}
+		o.DebugImages = "busybox:*"
+		if configure != nil {
+			configure(o)
+		}
+	})
+	return s, ts.URL + "/api/v1/namespaces/default/pods/web-0/debug?image=busybox:1.36&target=app", &apiRequests
+}
+
+func TestDebugChecksBeforeCreatingContainers(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		allowed string
+		policy  string
+		query   string
+		status  int
+	}{
+		{"allowed command", "/bin/sh", "", "&command=/bin/sh", http.StatusNotFound},
+		{"command not allowed", "/bin/sh", "", "&command=/bin/bash", http.StatusForbidden},
+		{"entrypoint with -allowed-commands", "/bin/sh", "", "", http.StatusForbidden},
+		{"command not in the policy", "", `commands: ["/bin/sh"]`, "&command=/bin/bash", http.StatusForbidden},
+		{"target not in the policy", "", `containers: ["db"]`, "", http.StatusForbidden},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, u, apiRequests := newDebugTestServer(t, func(o *Options) {
+				o.AllowedCommands = test.allowed
+				if len(test.policy) != 0 {
+					o.PolicyFile = writePolicy(t, test.policy)
+				}
+			})
+			status, _ := download(t, u+test.query, nil)
+			if status != test.status {
+				t.Errorf("got status %d, want %d", status, test.status)
+			}
+			//Only the allowed request goes on to look up the pod, which the API server doesn't know
+			if reached := atomic.LoadInt64(apiRequests) != 0; reached != (test.status == http.StatusNotFound) {
+				t.Errorf("got %d API server requests", atomic.LoadInt64(apiRequests))
+			}
+		})
+	}
+}
+
+func TestDebugIsAdmitted(t *testing.T) {
+	s, u, apiRequests := newDebugTestServer(t, func(o *Options) {
+		o.AllowedOrigins = "https://good.example"
+		o.MaxSessions = 1
+	})
+	if status, _ := download(t, u, http.Header{"Origin": {"https://evil.example"}}); status != http.StatusForbidden {
+		t.Errorf("bad origin: got status %d, want 403", status)
+	}
+
+	//Another client holds the only session slot
+	if err := s.sessions.reserve("192.0.2.1", ""); err != nil {
+		t.Fatal(err)
+	}
+	status, _ := download(t, u, nil)
+	s.sessions.release("192.0.2.1", "")
+	if status != http.StatusTooManyRequests {
+		t.Errorf("over -max-sessions: got status %d, want 429", status)
+	}
+	if n := atomic.LoadInt64(apiRequests); n != 0 {
+		t.Errorf("rejected requests made %d API server requests", n)
+	}
+}
+
+func TestDebugAuthzWebhookSeesImageAndProfile(t *testing.T) {
+	inputs := make(chan authzInput, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input authzInput `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		inputs <- body.Input
+		w.Write([]byte(`{"result": false}`))
+	}))
+	defer webhook.Close()
+	_, u, apiRequests := newDebugTestServer(t, func(o *Options) { o.AuthzWebhookURL = webhook.URL })
+
+	if status, body := download(t, u+"&profile=baseline", nil); status != http.StatusForbidden {
+		t.Errorf("denied by the webhook: got status %d %s, want 403", status, body)
+	}
+	var input authzInput
+	select {
+	case input = <-inputs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook wasn't asked")
+	}
+	if input.Endpoint != "debug" || input.Container != "app" || input.Image != "busybox:1.36" || input.Profile != "baseline" {
+		t.Errorf("webhook got %+v, want the target, image and profile", input)
+	}
+	if n := atomic.LoadInt64(apiRequests); n != 0 {
+		t.Errorf("denied request made %d API server requests", n)
+	}
+}
@@ -0,0 +1,476 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Shortest detach token accepted, since knowing the token is enough to take over the session.
+const minDetachToken = 16
+
+//randomToken returns an unguessable token for the server to hand out, such as a resume or share token
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//detachableSession owns an exec or attach stream that outlives its ws. When the client goes away
+//the stream keeps running for -detach-timeout, and a client reconnecting with the same detach
+//token takes it over after the last -scrollback bytes of output are replayed to it.
+//Resumable sessions instead get a server issued token and only survive connection losses for
+//-resume-window, replaying just the output produced meanwhile.
+type detachableSession struct {
+	mu        sync.Mutex
+	server    *Server
+	token     string
+	resumable bool
+	timeout   time.Duration
+	endpoint  string
+	namespace string
+	podName   string
+	logger    *sessionLogger
+	sio       *sessionIO
+	limiter   *rate.Limiter
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error
+
+	//Recent output, merged per channel and trimmed from the front to -scrollback bytes.
+	//Resumable sessions only keep what was produced while detached.
+	scrollback []outputChunk
+	buffered   int
+
+	//User who started the session, as requestUser names it, the only one who may reattach
+	owner string
+
+	//Releases the session slot reserved for the first client, once the stream ends
+	release func()
+
+	//Set when the client of a resumable session closed the ws on purpose
+	closed bool
+
+	//Attached client, its connection and the func ending it, nil while detached
+	client       *chanWriter
+	clientWs     *websocket.Conn
+	cancelClient context.CancelFunc
+
+	//Ends the stream once the session stayed detached for -detach-timeout
+	expiry  *time.Timer
+	expired bool
+}
+
+//detachRegistry indexes the live detachable sessions by token
+type detachRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*detachableSession
+}
+
+//add registers s, returning false when its token is already in use
+func (d *detachRegistry) add(s *detachableSession) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.sessions[s.token]; ok {
+		return false
+	}
+	d.sessions[s.token] = s
+	return true
+}
+
+func (d *detachRegistry) remove(token string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.sessions, token)
+}
+
+//get returns the live session with token, provided it targets the same endpoint and pod
+func (d *detachRegistry) get(token, endpoint, namespace, podName string) *detachableSession {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.sessions[token]
+	if !ok || s.endpoint != endpoint || s.namespace != namespace || s.podName != podName {
+		return nil
+	}
+	return s
+}
+
+//serveDetachable starts the stream of a new detachable session and serves its first client. The session
+//owns release, the session slot it holds until the stream ends.
+func (s *Server) serveDetachable(ws *websocket.Conn, r *http.Request, executor remotecommand.Executor, opts *execOptions, endpoint string, logger *sessionLogger, release func()) {
+	ctx, cancel := context.WithCancel(sessionContext(r))
+	d := &detachableSession{
+		server:    s,
+		token:     opts.detach,
+		timeout:   s.opts.DetachTimeout,
+		endpoint:  endpoint,
+		namespace: opts.namespace,
+		podName:   opts.podName,
+		logger:    logger,
+		owner:     logger.owner,
+		release:   release,
+		limiter:   opts.limiter,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	if len(opts.resumeToken) != 0 {
+		d.token, d.timeout, d.resumable = opts.resumeToken, s.opts.ResumeWindow, true
+	}
+
+	sio, err := s.newSessionIO(logger, opts, d.output(stdoutChannel), d.output(stderrChannel))
+	if err != nil {
+		cancel()
+		release()
+		logger.errorf("%v", err)
+		s.errToWs(ws, websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+	d.sio = sio
+
+	if !s.detachable.add(d) {
+		cancel()
+		release()
+		sio.end(nil)
+		sio.close()
+		logger.ended("rejected: detach token in use")
+		s.errToWs(ws, websocket.ClosePolicyViolation, "detach token already in use")
+		return
+	}
+	//The session rather than its connection is registered, so it is listed, counted and drained while detached
+	if !s.sessions.add(d, logger) {
+		s.detachable.remove(d.token)
+		cancel()
+		release()
+		sio.end(nil)
+		sio.close()
+		logger.ended("rejected: server draining")
+		s.errToWs(ws, websocket.CloseTryAgainLater, "server draining")
+		return
+	}
+
+	logger.infof("session started endpoint=%s command=%q tty=%t stdin=%t detachable=%t resumable=%t", endpoint, logger.record.Command, opts.tty, opts.stdin, !d.resumable, d.resumable)
+	events := s.startSessionEvents(s.requestCluster(r).clientset, opts.namespace, opts.podName, opts.containerName, s.eventIdentity(r))
+	go d.run(ctx, executor, opts.tty, events)
+	d.serve(ws, opts.enc, opts.idleTimeout)
+}
+
+//run streams until the command exits or the session is stopped, then ends the session
+func (s *detachableSession) run(ctx context.Context, executor remotecommand.Executor, tty bool, events *sessionEvents) {
+	//Unregistered last, so shutdown waits for the session to be logged and audited
+	defer s.server.sessions.remove(s)
+	defer s.release()
+
+	//The lifetime counts from the start of the stream, across reattaches
+	stopTimer := s.server.limitDuration(s.logger, s.output(stderrChannel))
+	ctx, span := tracer.Start(ctx, "stream")
+	err := executor.StreamWithContext(ctx, s.sio.streamOptions(tty))
+	endSpan(span, err)
+	stopTimer()
+	s.sio.close()
+	s.server.detachable.remove(s.token)
+
+	s.mu.Lock()
+	s.err = err
+	expired, closed := s.expired, s.closed
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	close(s.done)
+	s.mu.Unlock()
+	events.end(err)
+	s.sio.end(err)
+
+	code, ok := exitCode(err)
+	switch {
+	case expired:
+		s.logger.ended("detached for too long")
+	case closed:
+		s.logger.ended("client disconnected")
+	case !ok:
+		streamErrors.WithLabelValues(s.endpoint).Inc()
+		s.logger.errorf("stream: %v", err)
+		s.logger.ended("stream failed")
+	default:
+		s.logger.ended(fmt.Sprintf("command exited exitCode=%d", code))
+	}
+}
+
+//reattach hands the session over to the client of r, provided it is the session's owner
+func (s *detachableSession) reattach(guard *responseGuard, r *http.Request, opts *execOptions) {
+	if user := s.server.requestUser(r); user != s.owner {
+		s.logger.infof("reattach rejected: user %q is not the session owner remote=%s", user, r.RemoteAddr)
+		httpError(guard, http.StatusForbidden, "only the user who started the session may reattach to it")
+		return
+	}
+
+	ws, err := s.server.upgradeWs(guard, r, s.logger, nil)
+	if err != nil {
+		s.logger.errorf("upgrade: %v", err)
+		upgradeFailures.Inc()
+		return
+	}
+	defer ws.Close()
+
+	if !opts.compress {
+		ws.EnableWriteCompression(false)
+	}
+
+	//The policy may have changed since the session started, and the new client must be authorized too
+	err = s.server.policy.checkTarget(r.Context(), s.server.requestCluster(r).clientset, s.namespace, s.podName, s.logger.record.Container)
+	if err == nil {
+		err = s.server.authorize(r, s.endpoint, s.namespace, s.podName, s.logger.record.Container, s.logger.record.Command)
+	}
+	if err != nil {
+		s.logger.infof("reattach rejected: %v", err)
+		s.server.errToWs(ws, websocket.ClosePolicyViolation, err.Error())
+		return
+	}
+
+	s.logger.infof("session reattached remote=%s", r.RemoteAddr)
+	s.serve(ws, opts.enc, opts.idleTimeout)
+}
+
+//serve bridges ws to the stream until the client goes away, is replaced by a reattaching one,
+//or the stream ends
+func (s *detachableSession) serve(ws *websocket.Conn, enc *frameEncoding, idleTimeout time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	k := s.server.startKeepalive(ctx, ws, idleTimeout)
+
+	writer := newChanWriter()
+	writerDone := make(chan struct{})
+	go func() {
+		s.server.handleWriter(writer, ws, k, enc, s.logger)
+		close(writerDone)
+	}()
+
+	//The stream's size queue and stdin outlive this connection, so the reader gets its own
+	sizes := newSizeQueue()
+	go func() {
+		for size := sizes.Next(); size != nil; size = sizes.Next() {
+			s.sio.sizes.push(*size)
+		}
+	}()
+	var dp stdinPipe
+	if s.sio.dp != nil {
+		dp = sharedStdin{s.sio.dp}
+	}
+
+	//Only an abnormal loss of the connection keeps a resumable session for its client to come back
+	if s.resumable {
+		closeHandler := ws.CloseHandler()
+		ws.SetCloseHandler(func(code int, text string) error {
+			s.mu.Lock()
+			if s.client == writer {
+				s.closed = true
+			}
+			s.mu.Unlock()
+			return closeHandler(code, text)
+		})
+	}
+
+	s.attach(ws, writer, cancel)
+	readerDone := make(chan struct{})
+	go func() {
+		s.server.handleReader(ctx, cancel, ws, k, dp, sizes, enc, s.limiter, writer.stderr(), s.logger)
+		close(readerDone)
+	}()
+	//As in serveSession, nothing of this connection outlives serve
+	defer func() {
+		cancel()
+		<-readerDone
+	}()
+
+	select {
+	case <-ctx.Done():
+		if s.detach(writer) {
+			s.logger.infof("client detached, keeping the session for %s", s.timeout)
+		} else if s.closing(writer) {
+			s.logger.infof("client closed the session")
+			s.cancel()
+		} else {
+			s.logger.infof("client replaced by a reattached one")
+		}
+		writer.Close()
+	case <-s.done:
+		cancel()
+		if code, ok := exitCode(s.err); ok {
+			writer.closeWithExit(code)
+		} else {
+			writer.closeWithError(s.err)
+		}
+	}
+	<-writerDone
+}
+
+//attach replays the scrollback to writer and makes it the session's client, disconnecting the
+//client it replaces
+func (s *detachableSession) attach(ws *websocket.Conn, writer *chanWriter, cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if s.cancelClient != nil {
+		s.cancelClient()
+	}
+	for _, chunk := range s.scrollback {
+		writer.send(chunk.channel, chunk.data)
+	}
+	//Resumed clients already saw everything before the connection was lost
+	if s.resumable {
+		s.scrollback, s.buffered = nil, 0
+	}
+	s.client, s.clientWs, s.cancelClient = writer, ws, cancel
+}
+
+//detach starts the detach or resume countdown if writer is still the session's client, returning
+//false when another client took over in the meantime or the client of a resumable session closed it
+func (s *detachableSession) detach(writer *chanWriter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != writer || s.closed {
+		return false
+	}
+	s.client, s.clientWs, s.cancelClient = nil, nil, nil
+	select {
+	case <-s.done:
+	default:
+		s.expiry = time.AfterFunc(s.timeout, s.expire)
+	}
+	return true
+}
+
+//closing reports whether writer's client ended the resumable session by closing the ws
+func (s *detachableSession) closing(writer *chanWriter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.client == writer && s.closed
+}
+
+//expire stops the stream of a session nobody reattached in time
+func (s *detachableSession) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//A client may have reattached just as the timer fired
+	if s.client != nil {
+		return
+	}
+	s.expired = true
+	s.logger.infof("no client reattached within %s", s.timeout)
+	s.cancel()
+}
+
+//Close stops the stream, ending the session whether a client is attached or not
+func (s *detachableSession) Close() error {
+	s.cancel()
+	return nil
+}
+
+//stop asks the attached client, if any, to disconnect with a ws close code and reason, and stops the
+//stream rather than keeping it for the client to come back
+func (s *detachableSession) stop(code int, reason string) {
+	s.mu.Lock()
+	ws := s.clientWs
+	s.mu.Unlock()
+
+	if ws != nil {
+		s.server.sessions.askClose(ws, code, reason)
+	}
+	s.cancel()
+}
+
+//attached reports whether a client is connected to the session
+func (s *detachableSession) attached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.client != nil
+}
+
+//output returns a writer framing the stream's output on channel
+func (s *detachableSession) output(channel byte) io.Writer {
+	return sessionOutput{s, channel}
+}
+
+type sessionOutput struct {
+	s       *detachableSession
+	channel byte
+}
+
+//Write keeps p in the scrollback and passes it on to the attached client. Output for a client
+//that went away is not an error, the next one gets it from the scrollback.
+func (o sessionOutput) Write(p []byte) (int, error) {
+	o.s.mu.Lock()
+	client := o.s.client
+	if !o.s.resumable || client == nil {
+		o.s.remember(o.channel, p)
+	}
+	o.s.mu.Unlock()
+
+	if client != nil {
+		client.send(o.channel, p)
+	}
+	return len(p), nil
+}
+
+//remember appends p to the scrollback, dropping the oldest output beyond -scrollback bytes
+func (s *detachableSession) remember(channel byte, p []byte) {
+	if s.server.opts.Scrollback <= 0 || len(p) == 0 {
+		return
+	}
+	if n := len(s.scrollback); n != 0 && s.scrollback[n-1].channel == channel {
+		s.scrollback[n-1].data = append(s.scrollback[n-1].data, p...)
+	} else {
+		s.scrollback = append(s.scrollback, outputChunk{channel: channel, data: append([]byte(nil), p...)})
+	}
+	s.buffered += len(p)
+
+	for s.buffered > s.server.opts.Scrollback {
+		excess := s.buffered - s.server.opts.Scrollback
+		first := &s.scrollback[0]
+		if len(first.data) > excess {
+			first.data = first.data[excess:]
+			s.buffered -= excess
+			break
+		}
+		s.buffered -= len(first.data)
+		s.scrollback = s.scrollback[1:]
+	}
+}
+
+//sharedStdin lets a connection write to the stream's stdin without closing it when the connection ends
+type sharedStdin struct {
+	stdinPipe
+}
+
+func (sharedStdin) Close() error {
+	return nil
+}
+
+func (s sharedStdin) receiveDataWithin(data []byte, timeout time.Duration) (int, error) {
+	if p, ok := s.stdinPipe.(timedStdinPipe); ok {
+		return p.receiveDataWithin(data, timeout)
+	}
+	return s.receiveData(data)
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"net/http"
+	b64 "encoding/base64"
+
+	"github.com/gorilla/websocket"
+)
+
+//Supported base64 variants, selectable with the -base64 flag or the base64 query param
+var base64Encodings = map[string]*b64.Encoding{
+	"std":    b64.StdEncoding,
+	"url":    b64.URLEncoding,
+	"rawstd": b64.RawStdEncoding,
+	"rawurl": b64.RawURLEncoding,
+}
+
+//lookupEncoding returns the base64 variant registered under name
+func lookupEncoding(name string) (*b64.Encoding, error) {
+	enc, ok := base64Encodings[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported base64 encoding %q", name)
+	}
+	return enc, nil
+}
+
+//decodeBase64 decodes src with the negotiated encoding, falling back to detecting
+//URL-safe alphabet and missing padding so a mismatched client doesn't drop the session
+func decodeBase64(enc *b64.Encoding, src []byte) ([]byte, error) {
+	data := make([]byte, enc.DecodedLen(len(src)))
+	n, err := enc.Decode(data, src)
+	if err == nil {
+		return data[:n], nil
+	}
+
+	s := strings.TrimRight(string(src), "=")
+	if strings.ContainsAny(s, "-_") {
+		enc = b64.RawURLEncoding
+	} else {
+		enc = b64.RawStdEncoding
+	}
+
+	data = make([]byte, enc.DecodedLen(len(s)))
+	n, err = enc.Decode(data, []byte(s))
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+//frameEncoding turns channel data into ws frames and back, as base64 text frames by default
+//or as binary frames carrying the raw bytes after the channel prefix
+type frameEncoding struct {
+	//base64 variant of text frames, nil for binary frames
+	b64 *b64.Encoding
+
+	//Kubernetes subprotocol negotiated during the upgrade, empty for the proxy's own framing
+	protocol string
+}
+
+//requestEncoding returns the frame encoding of a Kubernetes subprotocol offered by the client,
+//otherwise the one negotiated with encoding=binary, or the base64 variant asked for with the
+//base64 param, defaulting to the server-wide one
+func (s *Server) requestEncoding(r *http.Request) (*frameEncoding, error) {
+	if protocol := negotiatedSubprotocol(r); len(protocol) != 0 {
+		return k8sEncoding(protocol), nil
+	}
+
+	vals := r.URL.Query()
+	switch v := vals.Get("encoding"); v {
+	case "binary":
+		return &frameEncoding{}, nil
+	case "", "base64":
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", v)
+	}
+
+	name := s.opts.Base64
+	if v := vals.Get("base64"); len(v) != 0 {
+		name = v
+	}
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	return &frameEncoding{b64: enc}, nil
+}
+
+//frame returns the message type and contents of the frame carrying data on channel
+func (e *frameEncoding) frame(channel byte, data []byte) (int, []byte) {
+	if e.b64 == nil {
+		return websocket.BinaryMessage, append([]byte{e.prefix(channel)}, data...)
+	}
+	return websocket.TextMessage, []byte(string(channel) + e.b64.EncodeToString(data))
+}
+
+//parse splits a frame into its channel and decoded data
+func (e *frameEncoding) parse(message []byte) (byte, []byte, error) {
+	channel := e.channel(message[0])
+	if e.b64 == nil {
+		return channel, message[1:], nil
+	}
+	data, err := decodeBase64(e.b64, message[1:])
+	return channel, data, err
+}
+
+//maxData returns the most data that fits in a frame of maxMessage bytes
+func (e *frameEncoding) maxData(maxMessage int) int {
+	if e.b64 == nil {
+		return maxMessage - 1
+	}
+	return e.b64.DecodedLen(maxMessage - 1)
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//Environment variable names accepted from clients, anything else could be shell syntax
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+//wrapEnv prefixes command with `env KEY=VALUE ...` so the exec session starts with the
+//requested environment. env runs the command directly, so values are never parsed by a shell.
+func wrapEnv(env []string, command []string) ([]string, error) {
+	if len(env) == 0 {
+		return command, nil
+	}
+
+	wrapped := []string{"env"}
+	for _, entry := range env {
+		key, _, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("env %q is not in KEY=VALUE form", entry)
+		}
+		if !envKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("env name %q is not a valid variable name", key)
+		}
+		wrapped = append(wrapped, entry)
+	}
+	return append(wrapped, command...), nil
+}
+
+//envNames returns the names of the KEY=VALUE env entries
+func envNames(env []string) []string {
+	var names []string
+	for _, entry := range env {
+		key, _, _ := strings.Cut(entry, "=")
+		names = append(names, key)
+	}
+	return names
+}
+
+//Shell wrapCwd runs commands through
+const cwdShell = "/bin/sh"
+
+//Script run by sh to enter the working directory, given as $1, before running the rest of the arguments.
+//Passing the directory as an argument keeps it out of the script, so it's never parsed by the shell.
+const cwdScript = `cd "$1" && shift && exec "$@"`
+
+//wrapCwd runs command through sh, changing to dir first so the session starts in it. The container
+//needs a /bin/sh for it.
+func wrapCwd(dir string, command []string) ([]string, error) {
+	if len(dir) == 0 {
+		return command, nil
+	}
+	if !strings.HasPrefix(dir, "/") || strings.ContainsRune(dir, 0) {
+		return nil, fmt.Errorf("cwd %q is not an absolute path", dir)
+	}
+	return append([]string{cwdShell, "-c", cwdScript, "sh", dir}, command...), nil
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Time allowed for each Kubernetes API call made to record an event.
+	eventTimeout = 5 * time.Second
+
+	// Component reported as the source of emitted events.
+	eventComponent = "k8s-proxy"
+)
+
+//sessionEvents records the start and end of an exec session as Events on the target pod
+type sessionEvents struct {
+	limiter   *rate.Limiter
+	client    kubernetes.Interface
+	pod       corev1.ObjectReference
+	container string
+	identity  string
+}
+
+//eventIdentity names who opened the session of r in its events: the user, or the client address of
+//anonymous requests
+func (s *Server) eventIdentity(r *http.Request) string {
+	if user := s.requestUser(r); len(user) != 0 {
+		return user
+	}
+	return r.RemoteAddr
+}
+
+//startSessionEvents emits the session start event, returning nil when -emit-k8s-events is off
+//or the pod can't be resolved. A nil *sessionEvents is safe to use.
+func (s *Server) startSessionEvents(client kubernetes.Interface, namespace, podName, containerName, identity string) *sessionEvents {
+	if !s.opts.EmitK8sEvents {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+
+	//The pod UID is needed for the event to show up in kubectl describe
+	pod, err := client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		errorf("event: %v", err)
+		return nil
+	}
+
+	e := &sessionEvents{
+		limiter: s.eventLimiter,
+		client:  client,
+		pod: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  pod.Namespace,
+			Name:       pod.Name,
+			UID:        pod.UID,
+		},
+		container: containerName,
+		identity:  identity,
+	}
+	e.emit(corev1.EventTypeNormal, "ExecStarted", fmt.Sprintf("Exec session started by %s%s", identity, e.target()))
+	return e
+}
+
+//end emits the session end event with the outcome of the stream
+func (e *sessionEvents) end(err error) {
+	if e == nil {
+		return
+	}
+
+	if err != nil {
+		e.emit(corev1.EventTypeWarning, "ExecFailed", fmt.Sprintf("Exec session by %s%s failed: %v", e.identity, e.target(), err))
+		return
+	}
+	e.emit(corev1.EventTypeNormal, "ExecEnded", fmt.Sprintf("Exec session by %s%s ended", e.identity, e.target()))
+}
+
+func (e *sessionEvents) target() string {
+	if len(e.container) == 0 {
+		return ""
+	}
+	return " in container " + e.container
+}
+
+//emit creates the event in the background, dropping it if the rate limit is exceeded
+func (e *sessionEvents) emit(eventType, reason, message string) {
+	if !e.limiter.Allow() {
+		infof("event: rate limited, dropping %s for %s/%s", reason, e.pod.Namespace, e.pod.Name)
+		return
+	}
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: e.pod.Name + ".",
+			Namespace:    e.pod.Namespace,
+		},
+		InvolvedObject: e.pod,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+		defer cancel()
+
+		if _, err := e.client.CoreV1().Events(event.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+			errorf("event: %v", err)
+		}
+	}()
+}
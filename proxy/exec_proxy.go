@@ -0,0 +1,1107 @@
+package proxy
+
+import (
+	"io"
+	"errors"
+	"os"
+	"fmt"
+	"sync"
+	"context"
+	"net"
+	"time"
+	"strings"
+	"strconv"
+	"net/http"
+	"encoding/json"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Prefixes of ws frames, identifying the stream they carry.
+const (
+	stdinChannel  = '0'
+	stdoutChannel = '1'
+	stderrChannel = '2'
+	exitChannel   = '3'
+	resizeChannel = '4'
+)
+
+const (
+	// Time allowed for the which lookup to complete.
+	whichTimeout = 5 * time.Second
+
+	// Seconds a client refused for exceeding session limits is asked to wait.
+	sessionRetryAfter = "10"
+)
+
+//newRouter sets up the API, served for the default cluster and under /clusters/{cluster} for the others
+func (s *Server) newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Use(nameSpan)
+	podAPI := router.PathPrefix("/api/v1/namespaces/{namespace}/pods/{podName}").Subrouter()
+	clusterPodAPI := router.PathPrefix("/clusters/{cluster}/api/v1/namespaces/{namespace}/pods/{podName}").Subrouter()
+	for _, api := range []*mux.Router{podAPI, clusterPodAPI} {
+		api.Use(s.routeCluster)
+		api.HandleFunc("/exec", s.serveWs).Methods("GET")
+		api.HandleFunc("/exec", s.serveWs).Methods("POST")
+		api.HandleFunc("/attach", s.serveAttach).Methods("GET")
+		api.HandleFunc("/debug", s.serveDebug).Methods("GET")
+		api.HandleFunc("/which", s.serveWhich).Methods("GET")
+		api.HandleFunc("/log", s.serveLogs).Methods("GET")
+		api.HandleFunc("/containers", s.serveContainers).Methods("GET")
+		api.HandleFunc("/portforward", s.servePortForward).Methods("GET")
+		api.HandleFunc("/cp", s.serveCopyFrom).Methods("GET")
+		api.HandleFunc("/cp", s.serveCopyTo).Methods("POST")
+	}
+	router.HandleFunc("/healthz", s.serveHealthz).Methods("GET")
+	router.HandleFunc("/readyz", s.serveReadyz).Methods("GET")
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	router.HandleFunc("/status", s.serveStatus).Methods("GET")
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.requireAdmin)
+	admin.HandleFunc("/drain", s.serveDrain).Methods("POST")
+	admin.HandleFunc("/sessions", s.serveSessions).Methods("GET")
+	admin.HandleFunc("/sessions/{id}", s.serveKillSession).Methods("DELETE")
+	router.HandleFunc("/sessions/{id}/share", s.serveShareSession).Methods("POST")
+	router.HandleFunc(sharedPathPrefix+"{token}", s.serveObserver).Methods("GET")
+
+	return router
+}
+
+//newAuthenticator returns the authentication middleware the flags ask for, shared by the HTTP and gRPC listeners
+func (s *Server) newAuthenticator() (func(http.Handler) http.Handler, error) {
+	var tokens *tokenStore
+	if len(s.opts.AuthTokenFile) != 0 {
+		var err error
+		if tokens, err = newTokenStore(s.opts.AuthTokenFile); err != nil {
+			return nil, err
+		}
+		if !s.opts.ValidateConfig {
+			tokens.watch(s.ctx)
+		}
+	}
+	if len(s.opts.AdminTokenFile) != 0 {
+		var err error
+		if s.adminTokens, err = newTokenStore(s.opts.AdminTokenFile); err != nil {
+			return nil, err
+		}
+		if !s.opts.ValidateConfig {
+			s.adminTokens.watch(s.ctx)
+		}
+	}
+	var verifier *oidcVerifier
+	if len(s.opts.OIDCIssuerURL) != 0 {
+		var err error
+		if verifier, err = newOIDCVerifier(s.opts.OIDCIssuerURL, s.opts.OIDCClientID, s.opts.OIDCUsernameClaim, s.opts.OIDCGroupsClaim); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(handler http.Handler) http.Handler {
+		if s.opts.PassThroughToken {
+			handler = requireBearer(handler)
+		}
+		if tokens != nil {
+			handler = requireToken(tokens, s.adminTokens, handler)
+		}
+		if s.opts.Authenticate != nil {
+			handler = requireHook(s.opts.Authenticate, handler)
+		}
+		if verifier != nil {
+			handler = requireOIDC(verifier, handler)
+		}
+		return handler
+	}, nil
+}
+
+//newHandler wraps router in the CORS middleware and authenticate
+func (s *Server) newHandler(router http.Handler, authenticate func(http.Handler) http.Handler) http.Handler {
+	//Preflight requests are answered before the token check, and traced like any request. The client
+	//address and path prefix are sorted out before anything else looks at them.
+	return s.forwardedHeaders(s.stripBasePath(traceRequests(s.allowCORS(authenticate(router)))))
+}
+
+//execOptions holds the validated parameters of an exec session
+type execOptions struct {
+	namespace     string
+	podName       string
+	containerName string
+	enc           *frameEncoding
+	limiter       *rate.Limiter
+	prefix        string
+	compress      bool
+	size          remotecommand.TerminalSize
+	command       []string
+	env           []string
+	cwd           string
+	tty           bool
+	stdin         bool
+	idleTimeout   time.Duration
+	detach        string
+	resume        string
+	resumeToken   string
+}
+
+//parseExecOptions validates the exec request. It never writes to the response,
+//leaving serveWs to either reject the request or upgrade it.
+func (s *Server) parseExecOptions(r *http.Request) (*execOptions, error) {
+	//Get container details
+	params := mux.Vars(r)
+	vals := r.URL.Query()
+	opts := &execOptions{
+		namespace: params["namespace"],
+		podName:   params["podName"],
+		compress:  vals.Get("compress") != "false",
+		command:   vals["command"],
+		env:       vals["env"],
+		cwd:       vals.Get("cwd"),
+		tty:       vals.Get("tty") != "false",
+		stdin:     vals.Get("stdin") != "false",
+	}
+
+	if err := validateTarget(opts.namespace, opts.podName); err != nil {
+		return nil, err
+	}
+
+	containerNames, ok := vals["container"]
+	if ok && len(containerNames) >= 1 {
+		opts.containerName = containerNames[0]
+	}
+
+	//Clients may negotiate binary frames or their base64 variant, defaulting to the server-wide one
+	enc, err := s.requestEncoding(r)
+	if err != nil {
+		return nil, err
+	}
+	opts.enc = enc
+
+	//Clients may tighten the stdin rate but never exceed the server-wide limit
+	bytesPerSec := s.opts.StdinRate
+	if v := vals.Get("stdin-rate"); len(v) != 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid stdin-rate %q", v)
+		}
+		if bytesPerSec <= 0 || n < bytesPerSec {
+			bytesPerSec = n
+		}
+	}
+	opts.limiter = newStdinLimiter(bytesPerSec)
+
+	//Long debugging sessions may ask for a longer inactivity timeout, within -max-read-timeout
+	opts.idleTimeout, err = s.requestIdleTimeout(vals)
+	if err != nil {
+		return nil, err
+	}
+
+	//Opt-in line prefix so merged views can tell sources apart
+	opts.prefix = vals.Get("prefix")
+
+	//Detachable sessions outlive their ws and are reattached with the same token
+	opts.detach = vals.Get("detach")
+	if len(opts.detach) != 0 {
+		if s.opts.DetachTimeout <= 0 {
+			return nil, errors.New("detachable sessions are disabled")
+		}
+		if len(opts.detach) < minDetachToken {
+			return nil, fmt.Errorf("detach token must be at least %d characters", minDetachToken)
+		}
+	}
+
+	//Resumable sessions are the others, resumed with the token the server issued
+	opts.resume = vals.Get("resume")
+	if len(opts.resume) != 0 && s.opts.ResumeWindow <= 0 {
+		return nil, errors.New("resumable sessions are disabled")
+	}
+	if len(opts.resume) != 0 && len(opts.detach) != 0 {
+		return nil, errors.New("resume and detach can't be combined")
+	}
+
+	//Initial terminal size, later updated through resize frames
+	opts.size = remotecommand.TerminalSize{Width: defaultCols, Height: defaultRows}
+	for name, dim := range map[string]*uint16{"cols": &opts.size.Width, "rows": &opts.size.Height} {
+		if v := vals.Get(name); len(v) != 0 {
+			n, err := strconv.ParseUint(v, 10, 16)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dim = uint16(n)
+		}
+	}
+	return opts, nil
+}
+
+func (s *Server) serveWs(w http.ResponseWriter, r *http.Request) {
+	s.serveSession(w, r, "exec", nil)
+}
+
+//serveSession bridges a ws to a new command in the container for the exec endpoint, or to its running
+//process for attach and debug. The session is admitted here unless the caller already reserved its
+//slot, passing the func releasing it as admitted for serveSession to release.
+func (s *Server) serveSession(w http.ResponseWriter, r *http.Request, endpoint string, admitted func()) {
+	attach := endpoint != "exec"
+
+	//Validation either fully handles the response or falls through to the upgrade, never both
+	guard := &responseGuard{ResponseWriter: w}
+	opts, err := s.parseExecOptions(r)
+	if err == nil && attach && (len(opts.command) != 0 || len(opts.env) != 0 || len(opts.cwd) != 0) {
+		err = errors.New("command, env and cwd can't be set when attaching")
+	}
+
+	//Reconnecting with the token of a live detachable session takes it over instead of starting a new one.
+	//The session kept its slot while detached, so the client doesn't reserve another.
+	if d, found := s.reattachTarget(opts, err, endpoint); found {
+		if admitted != nil {
+			admitted()
+		}
+		if d == nil {
+			httpError(guard, http.StatusNotFound, "no session to resume, it ended or its resume window passed")
+		} else if s.admitReattach(guard, r) {
+			d.reattach(guard, r, opts)
+		}
+		return
+	}
+
+	release := admitted
+	if release == nil {
+		var ok bool
+		if release, ok = s.admitSession(guard, r); !ok {
+			return
+		}
+	}
+	defer func() { release() }()
+	if err != nil {
+		httpError(guard, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//Multi-container pods need a container, fall back to the one kubectl would pick
+	if len(opts.containerName) == 0 {
+		var client kubernetes.Interface
+		client, err = s.requestClient(r)
+		if err == nil {
+			opts.containerName, err = defaultContainer(r.Context(), client, opts.namespace, opts.podName)
+		}
+		if err != nil {
+			httpError(guard, statusForError(err), err.Error())
+			return
+		}
+	}
+
+	logger := s.newSessionLogger(r, endpoint, opts.namespace, opts.podName, opts.containerName)
+
+	//Sessions that aren't detachable can be resumed after a lost connection with a token of the server's
+	var header http.Header
+	if s.opts.ResumeWindow > 0 && len(opts.detach) == 0 {
+		opts.resumeToken, err = randomToken()
+		if err != nil {
+			httpError(guard, http.StatusInternalServerError, err.Error())
+			return
+		}
+		header = http.Header{resumeTokenHeader: {opts.resumeToken}}
+	}
+
+	//Upgrade incoming client connection to ws
+	ws, err := s.upgradeWs(guard, r, logger, header)
+	if err != nil {
+		logger.errorf("upgrade: %v", err)
+		upgradeFailures.Inc()
+		return
+	}
+	defer ws.Close()
+	defer sessionStarted(endpoint, opts.namespace)()
+
+	namespace := opts.namespace
+	podName := opts.podName
+	containerName := opts.containerName
+
+	//Sessions streaming already-compressed data can opt out of compression
+	if !opts.compress {
+		ws.EnableWriteCompression(false)
+	}
+
+	//Attaching runs nothing new, so only the target is subject to the policy.
+	//Debug containers were checked and authorized against the container they target when created.
+	var commands []string
+	if endpoint == "debug" {
+		err = s.policy.checkPod(r.Context(), s.requestCluster(r).clientset, namespace, podName)
+	} else if attach {
+		err = s.policy.checkTarget(r.Context(), s.requestCluster(r).clientset, namespace, podName, containerName)
+		if err == nil {
+			err = s.authorize(r, endpoint, namespace, podName, containerName, nil)
+		}
+	} else {
+		commands, err = s.execSessionCommand(r, endpoint, opts)
+	}
+	if err != nil {
+		logger.ended(fmt.Sprintf("rejected: %v", err))
+		s.errToWs(ws, websocket.ClosePolicyViolation, err.Error())
+		return
+	}
+	logger.record.Command = commands
+
+	//Registered once the session is fully described, since the admin API reads it concurrently.
+	//Detachable sessions are registered by serveDetachable for as long as their stream runs.
+	detach := len(opts.detach) != 0 || len(opts.resumeToken) != 0
+	if !detach {
+		if !s.sessions.add(ws, logger) {
+			logger.ended("rejected: server draining")
+			s.errToWs(ws, websocket.CloseTryAgainLater, "server draining")
+			return
+		}
+		defer s.sessions.remove(ws)
+	}
+
+	//Open connection to k8s/OpenShift API
+	var req *rest.Request
+	if attach {
+		req = s.newAttachRequest(s.requestCluster(r).clientset, namespace, podName, containerName, opts.stdin, opts.tty)
+	} else {
+		req = s.newExecRequest(s.requestCluster(r).clientset, namespace, podName, containerName, commands, opts.stdin, opts.tty)
+	}
+
+	executor, err := s.newExecutor(s.requestConfig(r), s.opts.ExecMethod, req.URL())
+	if err != nil {
+		logger.errorf("creating executor: %v", err)
+		s.errToWs(ws, websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+
+	if detach {
+		//The session holds its slot until its stream ends, however long it stays detached
+		held := release
+		release = func() {}
+		s.serveDetachable(ws, r, executor, opts, endpoint, logger, held)
+		return
+	}
+
+	//A tty merges stderr into stdout, without one stderr gets its own channel
+	writer := newChanWriter()
+	sio, err := s.newSessionIO(logger, opts, writer, writer.stderr())
+	if err != nil {
+		logger.errorf("%v", err)
+		s.errToWs(ws, websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+	defer sio.close()
+	defer s.limitDuration(logger, writer.stderr())()
+
+	//Cancelled when either the client or the container side finishes, tearing down the other
+	ctx, cancel := context.WithCancel(sessionContext(r))
+	defer cancel()
+	k := s.startKeepalive(ctx, ws, opts.idleTimeout)
+
+	writerDone := make(chan struct{})
+	go func() {
+		s.handleWriter(writer, ws, k, opts.enc, logger)
+		close(writerDone)
+	}()
+	readerDone := make(chan struct{})
+	go func() {
+		s.handleReader(ctx, cancel, ws, k, sio.dp, sio.sizes, opts.enc, opts.limiter, writer.stderr(), logger)
+		close(readerDone)
+	}()
+
+	logger.infof("session started endpoint=%s command=%q tty=%t stdin=%t", endpoint, commands, opts.tty, opts.stdin)
+	events := s.startSessionEvents(s.requestCluster(r).clientset, namespace, podName, containerName, s.eventIdentity(r))
+
+	streamCtx, span := tracer.Start(ctx, "stream")
+	err = executor.StreamWithContext(streamCtx, sio.streamOptions(opts.tty))
+	endSpan(span, err)
+	clientGone := ctx.Err() != nil
+	cancel()
+	//Cancelling expires the reader's pending read and closes stdin, so it returns right away.
+	//Waiting for it and the writer leaves nothing of the session running once the handler returns.
+	<-readerDone
+	events.end(err)
+	sio.end(err)
+
+	//The client already left, there is nobody to report to
+	if clientGone {
+		logger.ended("client disconnected")
+		writer.Close()
+		<-writerDone
+		return
+	}
+
+	code, ok := exitCode(err)
+	if !ok {
+		streamErrors.WithLabelValues(endpoint).Inc()
+		logger.errorf("stream: %v", err)
+		logger.ended("stream failed")
+		writer.closeWithError(err)
+		<-writerDone
+		return
+	}
+
+	//Let the writer flush remaining output and report the exit code before closing
+	logger.ended(fmt.Sprintf("command exited exitCode=%d", code))
+	writer.closeWithExit(code)
+	<-writerDone
+}
+
+//reattachTarget returns the detachable session the detach or resume token of valid options takes over.
+//found is false for requests starting a new session, and true with a nil session when the session to
+//resume is gone.
+func (s *Server) reattachTarget(opts *execOptions, err error, endpoint string) (d *detachableSession, found bool) {
+	if err != nil {
+		return nil, false
+	}
+	if len(opts.detach) != 0 {
+		if d := s.detachable.get(opts.detach, endpoint, opts.namespace, opts.podName); d != nil && !d.resumable {
+			return d, true
+		}
+	}
+	if len(opts.resume) != 0 {
+		if d := s.detachable.get(opts.resume, endpoint, opts.namespace, opts.podName); d != nil && d.resumable {
+			return d, true
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+//execSessionCommand resolves the command of a new exec session, checks it and the requested environment
+//against the policy and the authz webhook, and wraps it to start with that environment
+func (s *Server) execSessionCommand(r *http.Request, endpoint string, opts *execOptions) ([]string, error) {
+	var commands []string
+	var err error
+	if len(opts.command) == 0 && len(s.shellChain) != 0 {
+		commands, err = s.probeShell(r, opts.namespace, opts.podName, opts.containerName)
+	} else {
+		commands, err = s.execCommand(opts.command)
+		if err == nil {
+			err = s.policy.check(r.Context(), s.requestCluster(r).clientset, opts.namespace, opts.podName, opts.containerName, commands)
+		}
+	}
+	if err == nil {
+		err = s.policy.checkEnv(opts.env, opts.cwd, len(s.allowedCommands) != 0)
+	}
+	//The cwd wrapping runs a shell, which must be allowed like any other binary
+	if err == nil && len(opts.cwd) != 0 && len(s.allowedCommands) != 0 && !s.allowedCommands[cwdShell] {
+		err = fmt.Errorf("cwd runs %s, which is not in the allowed commands", cwdShell)
+	}
+	if err == nil {
+		//The webhook sees the names of the variables, their values may be secrets
+		err = s.authorizeInput(r, authzInput{
+			Endpoint:  endpoint,
+			Namespace: opts.namespace,
+			Pod:       opts.podName,
+			Container: opts.containerName,
+			Command:   commands,
+			Env:       envNames(opts.env),
+			Cwd:       opts.cwd,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	commands, err = wrapCwd(opts.cwd, commands)
+	if err != nil {
+		return nil, err
+	}
+	return wrapEnv(opts.env, commands)
+}
+
+//sessionIO holds the streams of an exec or attach session as the executor sees them
+type sessionIO struct {
+	stdout    io.Writer
+	stderr    io.Writer
+	stdin     io.Reader
+	dp        stdinPipe
+	sizes     *sizeQueue
+	sizeQueue remotecommand.TerminalSizeQueue
+	rec       *recorder
+	observers *observerHub
+}
+
+//newSessionIO wires stdout and stderr through the line prefix, and the streams and terminal sizes
+//through the recording when the session is recorded. Without stdin, dp and stdin stay nil.
+func (s *Server) newSessionIO(logger *sessionLogger, opts *execOptions, stdout, stderr io.Writer) (*sessionIO, error) {
+	//Observers see the output as the client does, so they are fed before the prefix
+	observers := s.observed.newHub(logger)
+	stdout, stderr = observers.output(stdout, stdoutChannel), observers.output(stderr, stderrChannel)
+
+	if len(opts.prefix) != 0 {
+		prefix := expandPrefix(opts.prefix, opts.namespace, opts.podName, opts.containerName)
+		stdout = newPrefixWriter(stdout, prefix)
+		stderr = newPrefixWriter(stderr, prefix)
+	}
+
+	sizes := newSizeQueue()
+	sizes.push(opts.size)
+	sio := &sessionIO{stdout: stdout, stderr: stderr, sizes: sizes, sizeQueue: sizes, observers: observers}
+
+	//Recordings tee the streams as the container sees them, before any prefix is added
+	rec, err := s.startRecording(logger, opts.namespace, opts.podName, opts.containerName, opts.size)
+	if err != nil {
+		sizes.close()
+		observers.end(err)
+		return nil, err
+	}
+	if rec != nil {
+		sio.rec = rec
+		sio.stdout, sio.stderr = rec.output(stdout), rec.output(stderr)
+		sio.sizeQueue = rec.sizes(sizes)
+	}
+
+	//Without stdin the reader still serves resize frames but drops input
+	if opts.stdin {
+		sio.dp = s.newStdinPipe()
+		sio.stdin = sio.dp
+		if rec != nil {
+			sio.stdin = rec.input(sio.dp)
+		}
+	}
+	return sio, nil
+}
+
+func (s *sessionIO) streamOptions(tty bool) remotecommand.StreamOptions {
+	return remotecommand.StreamOptions{
+		Stdin:             s.stdin,  //io.Reader
+		Stdout:            s.stdout, //io.Writer
+		Stderr:            s.stderr, //io.Writer
+		Tty:               tty,
+		TerminalSizeQueue: s.sizeQueue,
+	}
+}
+
+//end reports the outcome of the stream to the observers
+func (s *sessionIO) end(err error) {
+	s.observers.end(err)
+}
+
+//close ends stdin and the terminal size queue and finishes the recording
+func (s *sessionIO) close() {
+	s.sizes.close()
+	if s.dp != nil {
+		s.dp.Close()
+	}
+	if s.rec != nil {
+		s.rec.Close()
+	}
+}
+
+//parseAllowedCommands parses the comma separated -allowed-commands list of binaries sessions may run.
+//An empty set allows any binary.
+func parseAllowedCommands(list string) map[string]bool {
+	allowed := make(map[string]bool)
+	for _, binary := range strings.Split(list, ",") {
+		binary = strings.TrimSpace(binary)
+		if len(binary) != 0 {
+			allowed[binary] = true
+		}
+	}
+	return allowed
+}
+
+//execCommand returns the command requested by the client, or an interactive shell when none was given.
+//The binary must be in -allowed-commands when that list is set.
+func (s *Server) execCommand(command []string) ([]string, error) {
+	if len(command) == 0 {
+		command = []string{"/bin/sh", "-i"}
+	}
+	for i, arg := range command {
+		if len(arg) == 0 {
+			return nil, fmt.Errorf("command element %d is empty", i)
+		}
+	}
+	if len(s.allowedCommands) != 0 && !s.allowedCommands[command[0]] {
+		return nil, fmt.Errorf("command %s is not in the allowed commands", command[0])
+	}
+	return command, nil
+}
+
+//newExecRequest builds the exec subresource request for a pod, targeting containerName when set
+func (s *Server) newExecRequest(client kubernetes.Interface, namespace, podName, containerName string, commands []string, stdin, tty bool) *rest.Request {
+	req := client.CoreV1().RESTClient().Verb(s.opts.ExecMethod).
+		Namespace(namespace).
+		Resource("pods").
+		Name(podName).
+		SubResource("exec")
+
+	if len(containerName) != 0 {
+		req.Param("container", containerName)
+	}
+	req.Param("stdin", strconv.FormatBool(stdin)).
+		Param("stdout", "true").
+		Param("stderr", "true").
+		Param("tty", strconv.FormatBool(tty))
+
+	for _, command := range commands {
+		req.Param("command", command)
+	}
+
+	debugf("exec request: namespace=%s pod=%s container=%q command=%q stdin=%t stdout=true stderr=true tty=%t method=%s url=%s",
+		namespace, podName, containerName, commands, stdin, tty, s.opts.ExecMethod, redactURL(req.URL()))
+	return req
+}
+
+//Send error msg to ws client, closing with code so it can tell client errors from server errors
+func (s *Server) errToWs(ws *websocket.Conn, code int, err string) {
+	ws.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, err))
+	time.Sleep(s.opts.CloseGrace)
+}
+
+//handleReader reads, decodes and forwards messages from ws connection to container stdin,
+//passing resize frames on to the terminal size queue instead. When the client goes away it
+//cancels ctx to stop the stream; when ctx is cancelled first it returns and leaves closing
+//the connection to handleWriter. Warnings about dropped stdin go to warn.
+func (s *Server) handleReader(ctx context.Context, cancel context.CancelFunc, ws *websocket.Conn, k *keepalive, dp stdinPipe, sizes *sizeQueue, enc *frameEncoding, limiter *rate.Limiter, warn io.Writer, logger *sessionLogger) {
+	defer sizes.close()
+	if dp != nil {
+		defer dp.Close()
+	}
+	ws.SetReadLimit(s.opts.MaxMessageSize)
+
+	//Unblock ReadMessage and pending stdin writes as soon as the stream is over
+	go func() {
+		<-ctx.Done()
+		k.expire()
+		if dp != nil {
+			dp.Close()
+		}
+	}()
+
+	stdinClosed := false
+	for {
+		k.activity()
+		if ctx.Err() != nil {
+			return
+		}
+		_, message, err := s.readMessage(ws)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if strings.Contains(err.Error(), "timeout") && k.idle() {
+				logger.infof("disconnected due to inactivity")
+				s.errToWs(ws, websocket.CloseGoingAway, "Disconnected due to inactivity")
+			} else if strings.Contains(err.Error(), "timeout") {
+				logger.infof("disconnected, no pong within %s", s.opts.PongTimeout)
+				ws.Close()
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				//Large pastes must be split by the client rather than failing with an opaque error
+				streamErrors.WithLabelValues("stdin").Inc()
+				logger.infof("frame over -max-message-size %d", s.opts.MaxMessageSize)
+				s.errToWs(ws, websocket.CloseMessageTooBig, fmt.Sprintf("frame larger than %d bytes, send stdin in smaller frames", s.opts.MaxMessageSize))
+			} else {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					streamErrors.WithLabelValues("stdin").Inc()
+					logger.errorf("read: %v", err)
+				}
+				s.errToWs(ws, websocket.CloseUnsupportedData, err.Error())
+			}
+
+			break
+		}
+		if len(message) == 0 {
+			continue
+		}
+
+		channel, data, err := enc.parse(message)
+		if err != nil {
+			streamErrors.WithLabelValues("stdin").Inc()
+			logger.errorf("decode: %v", err)
+			s.errToWs(ws, websocket.CloseUnsupportedData, err.Error())
+			break
+		}
+
+		//v5 clients signal the end of stdin instead of closing the ws
+		if channel == closeChannel {
+			if len(data) == 1 && data[0] == 0 && dp != nil {
+				logger.debugf("stdin closed by client")
+				dp.Close()
+				stdinClosed = true
+			}
+			continue
+		}
+
+		if channel == resizeChannel {
+			size, err := parseResize(data)
+			if err != nil {
+				streamErrors.WithLabelValues("stdin").Inc()
+				logger.errorf("resize: %v", err)
+				s.errToWs(ws, websocket.CloseUnsupportedData, err.Error())
+				break
+			}
+			logger.debugf("resize cols=%d rows=%d", size.Width, size.Height)
+			sizes.push(size)
+			continue
+		}
+		if dp == nil || stdinClosed {
+			continue
+		}
+
+		n, err := s.receiveLimited(ctx, dp, data, limiter)
+		logger.countIn(n)
+		if errors.Is(err, errStdinStalled) {
+			dropped := len(data) - n
+			stdinDropped.Add(float64(dropped))
+			logger.infof("stdin: container not reading, dropped %d bytes", dropped)
+			fmt.Fprintf(warn, "\r\n[k8s-proxy: container not reading stdin, %d bytes dropped]\r\n", dropped)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			streamErrors.WithLabelValues("stdin").Inc()
+			logger.errorf("stdin: %v", err)
+			s.errToWs(ws, websocket.CloseInternalServerErr, err.Error())
+			break
+		}
+	}
+
+	cancel()
+	ws.Close()
+}
+
+//handleWriter receives, encodes and forwards container output to ws connection
+func (s *Server) handleWriter(w *chanWriter, ws *websocket.Conn, k *keepalive, enc *frameEncoding, logger *sessionLogger) {
+	defer w.abort()
+
+	//Largest raw chunk whose prefixed frame still fits in maxMessageSize
+	maxChunk := enc.maxData(int(s.opts.MaxMessageSize))
+
+	var lastActivity time.Time
+	failed := false
+	for {
+		chunk, ok := w.nextBatch(maxChunk, s.opts.OutputFlushInterval)
+		if !ok {
+			break
+		}
+		if err := s.writeChunk(ws, enc, chunk.channel, chunk.data, maxChunk); err != nil {
+			streamErrors.WithLabelValues("stdout").Inc()
+			logger.errorf("write: %v", err)
+			s.errToWs(ws, websocket.CloseInternalServerErr, err.Error())
+			ws.Close()
+			failed = true
+			break
+		}
+		logger.countOut(len(chunk.data))
+		logger.debugf("wrote %d bytes on channel %c", len(chunk.data), chunk.channel)
+
+		//Output counts as use of the session, so push back the idle timeout.
+		//Dead peers still surface as write errors above or missing pongs.
+		if s.opts.OutputKeepalive && time.Since(lastActivity) > time.Second {
+			lastActivity = time.Now()
+			k.activity()
+		}
+	}
+
+	if !failed && w.exitCode != nil {
+		s.writeExitCode(ws, enc, *w.exitCode)
+	}
+	if !failed && w.closeErr != nil {
+		if payload, err := enc.errorPayload(w.closeErr); err == nil && payload != nil {
+			ws.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+			ws.WriteMessage(enc.frame(exitChannel, payload))
+		}
+		s.errToWs(ws, websocket.CloseInternalServerErr, w.closeErr.Error())
+		ws.Close()
+		return
+	}
+
+	//The exit status is repeated as close reason for clients that only look at the close frame
+	reason := ""
+	if !failed && w.exitCode != nil {
+		if payload, err := json.Marshal(exitMessage{ExitCode: *w.exitCode}); err == nil {
+			reason = string(payload)
+		}
+	}
+	ws.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+	time.Sleep(s.opts.CloseGrace)
+	ws.Close()
+}
+
+//writeChunk sends data as frames prefixed with channel, splitting it so no frame exceeds maxChunk raw bytes
+func (s *Server) writeChunk(ws *websocket.Conn, enc *frameEncoding, channel byte, data []byte, maxChunk int) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxChunk {
+			n = maxChunk
+		}
+
+		ws.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+		if err := ws.WriteMessage(enc.frame(channel, data[:n])); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+//errorResponse is the JSON body of every error returned before a ws upgrade
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+//httpError writes msg as a JSON error response
+func httpError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg, Code: status})
+}
+
+//writeJSON encodes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+//remoteIP returns the host part of the request's remote address
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func homeDir() string {
+	if h := os.Getenv("HOME"); h != "" {
+		return h
+	}
+	return os.Getenv("USERPROFILE") // windows
+}
+
+//outputChunk is a piece of container output and the channel it is framed on
+type outputChunk struct {
+	channel byte
+	data    []byte
+}
+
+type stderrWriter struct {
+	w *chanWriter
+}
+
+func (s stderrWriter) Write(p []byte) (int, error) {
+	return s.w.send(stderrChannel, p)
+}
+
+//Used to receive container output
+//The data channel is never closed since stream goroutines may still write after Close,
+//instead closed signals handleWriter to drain what is buffered and finish.
+type chanWriter struct {
+	ch        chan outputChunk
+	pending   *outputChunk
+	exitCode  *int
+	closeErr  error
+	closed    chan struct{}
+	closeOnce sync.Once
+	aborted   chan struct{}
+	abortOnce sync.Once
+}
+
+func newChanWriter() *chanWriter {
+	return &chanWriter{
+		ch:      make(chan outputChunk, 1024),
+		closed:  make(chan struct{}),
+		aborted: make(chan struct{}),
+	}
+}
+
+//next returns the next chunk of output, or false once the writer is closed and drained
+func (w *chanWriter) next() (outputChunk, bool) {
+	if w.pending != nil {
+		chunk := *w.pending
+		w.pending = nil
+		return chunk, true
+	}
+	select {
+	case chunk := <-w.ch:
+		return chunk, true
+	case <-w.closed:
+		select {
+		case chunk := <-w.ch:
+			return chunk, true
+		default:
+			return outputChunk{}, false
+		}
+	}
+}
+
+//nextBatch returns the next chunk merged with the output of the same channel that follows it, up to max bytes,
+//so a command doing many small writes doesn't produce a frame per write. With a positive wait it waits that long
+//for more output, otherwise only output that is already buffered is merged. Only handleWriter may call it.
+func (w *chanWriter) nextBatch(max int, wait time.Duration) (outputChunk, bool) {
+	chunk, ok := w.next()
+	if !ok {
+		return chunk, false
+	}
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for len(chunk.data) < max {
+		var more outputChunk
+		select {
+		case more = <-w.ch:
+		default:
+			if timeout == nil {
+				return chunk, true
+			}
+			select {
+			case more = <-w.ch:
+			case <-timeout:
+				return chunk, true
+			case <-w.closed:
+				return chunk, true
+			}
+		}
+
+		//Keep stdout and stderr apart, the other channel goes in the next batch
+		if more.channel != chunk.channel {
+			w.pending = &more
+			return chunk, true
+		}
+		//Fill the batch up to max, leaving the rest for the next one rather than a runt frame
+		if room := max - len(chunk.data); len(more.data) > room {
+			w.pending = &outputChunk{channel: more.channel, data: more.data[room:]}
+			more.data = more.data[:room]
+		}
+		if cap(chunk.data) < max {
+			chunk.data = append(make([]byte, 0, max), chunk.data...)
+		}
+		chunk.data = append(chunk.data, more.data...)
+	}
+	return chunk, true
+}
+
+//Write sends p as stdout output
+func (w *chanWriter) Write(p []byte) (int, error) {
+	return w.send(stdoutChannel, p)
+}
+
+//stderr returns a writer whose output is framed on the stderr channel
+func (w *chanWriter) stderr() io.Writer {
+	return stderrWriter{w}
+}
+
+//trySend is send without blocking, returning false when the channel is full or the writer aborted
+func (w *chanWriter) trySend(channel byte, p []byte) bool {
+	if len(p) == 0 {
+		return true
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	select {
+	case <-w.aborted:
+		return false
+	default:
+	}
+	select {
+	case w.ch <- outputChunk{channel: channel, data: data}:
+		return true
+	default:
+		return false
+	}
+}
+
+//send hands a copy of p to the channel, since the stream reuses its buffer
+func (w *chanWriter) send(channel byte, p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	select {
+	case w.ch <- outputChunk{channel: channel, data: data}:
+		return len(p), nil
+	case <-w.aborted:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+//abort makes further writes fail instead of blocking once nobody drains the channel
+func (w *chanWriter) abort() {
+	w.abortOnce.Do(func() { close(w.aborted) })
+}
+
+func (w *chanWriter) Close() error {
+	w.closeOnce.Do(func() { close(w.closed) })
+	return nil
+}
+
+//closeWithError closes the writer, having handleWriter close the connection with err once output is flushed
+func (w *chanWriter) closeWithError(err error) {
+	w.closeOnce.Do(func() {
+		w.closeErr = err
+		close(w.closed)
+	})
+}
+
+//closeWithExit closes the writer, recording code for handleWriter to report once output is flushed
+func (w *chanWriter) closeWithExit(code int) {
+	w.closeOnce.Do(func() {
+		w.exitCode = &code
+		close(w.closed)
+	})
+}
+
+//stdinPipe relays decoded ws messages to the container's stdin
+type stdinPipe interface {
+	io.ReadCloser
+	receiveData(data []byte) (int, error)
+}
+
+//timedStdinPipe is a stdinPipe that can give up on data the container doesn't read in time
+type timedStdinPipe interface {
+	stdinPipe
+	receiveDataWithin(data []byte, timeout time.Duration) (int, error)
+}
+
+//receiveStdin passes data to dp, dropping what the container didn't take within -stdin-stall-timeout
+func (s *Server) receiveStdin(dp stdinPipe, data []byte) (int, error) {
+	if p, ok := dp.(timedStdinPipe); ok && s.opts.StdinStallTimeout > 0 {
+		return p.receiveDataWithin(data, s.opts.StdinStallTimeout)
+	}
+	return dp.receiveData(data)
+}
+
+//newStdinPipe returns a ring buffered pipe when -stdin-buffer is set, and an unbuffered one otherwise
+func (s *Server) newStdinPipe() stdinPipe {
+	if s.opts.StdinBuffer > 0 {
+		return newRingPipe(s.opts.StdinBuffer)
+	}
+	return newDataPipe()
+}
+
+//Providing a pipe to relay messages between ws and container
+type dataPipe struct {
+	r io.Reader
+	w io.WriteCloser
+}
+
+func newDataPipe() *dataPipe {
+	r, w := io.Pipe()
+	return &dataPipe{r, w}
+}
+
+func (p *dataPipe) receiveData(data []byte) (int, error) {
+	return p.w.Write(data)
+}
+
+func (p *dataPipe) Read(data []byte) (int, error) {
+	i, e := p.r.Read(data)
+	return i, e
+}
+
+func (p *dataPipe) Close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestChanWriterBatches(t *testing.T) {
+	w := newChanWriter()
+	for _, data := range []string{"abc", "def", "gh"} {
+		w.Write([]byte(data))
+	}
+	w.stderr().Write([]byte("err"))
+	w.Write([]byte("i"))
+	w.Close()
+
+	//Batches are filled up to max and never mix stdout and stderr
+	want := []outputChunk{
+		{stdoutChannel, []byte("abcd")},
+		{stdoutChannel, []byte("efgh")},
+		{stderrChannel, []byte("err")},
+		{stdoutChannel, []byte("i")},
+	}
+	for _, want := range want {
+		chunk, ok := w.nextBatch(4, 0)
+		if !ok || chunk.channel != want.channel || string(chunk.data) != string(want.data) {
+			t.Fatalf("got batch %c %q, %t, want %c %q", chunk.channel, chunk.data, ok, want.channel, want.data)
+		}
+	}
+	if chunk, ok := w.nextBatch(4, 0); ok {
+		t.Fatalf("got batch %c %q after the output ended", chunk.channel, chunk.data)
+	}
+}
+
+const (
+	// Container output pushed through the writer per benchmark iteration.
+	benchOutputSize = 8 << 20
+
+	// Size of the container's writes, as a terminal or io.Copy would make them.
+	benchWriteSize = 4 << 10
+)
+
+//writeBenchOutput writes benchOutputSize bytes to w in benchWriteSize writes
+func writeBenchOutput(w *chanWriter) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), benchWriteSize/16)
+	for sent := 0; sent < benchOutputSize; sent += len(data) {
+		w.Write(data)
+	}
+}
+
+//reportFramesPerMiB reports how many frames carried each MiB of the output of b.N iterations
+func reportFramesPerMiB(b *testing.B, frames int) {
+	b.ReportMetric(float64(frames)/float64(b.N*(benchOutputSize>>20)), "frames/MiB")
+}
+
+//BenchmarkChanWriter measures batching output into frames, as handleWriter drains the writer
+func BenchmarkChanWriter(b *testing.B) {
+	maxChunk := (&frameEncoding{}).maxData(int(DefaultOptions().MaxMessageSize))
+	b.SetBytes(benchOutputSize)
+	b.ReportAllocs()
+
+	frames := 0
+	for i := 0; i < b.N; i++ {
+		w := newChanWriter()
+		go func() {
+			writeBenchOutput(w)
+			w.Close()
+		}()
+		for {
+			chunk, ok := w.nextBatch(maxChunk, 0)
+			if !ok {
+				break
+			}
+			frames += (len(chunk.data) + maxChunk - 1) / maxChunk
+		}
+	}
+	reportFramesPerMiB(b, frames)
+}
+
+//BenchmarkHandleWriter measures container output going out as ws frames to a client reading them
+func BenchmarkHandleWriter(b *testing.B) {
+	opts := DefaultOptions()
+	opts.ExecBackend = "echo"
+	opts.RESTConfig = &rest.Config{Host: "http://127.0.0.1:1"}
+	opts.CloseGrace = time.Millisecond
+	opts.PingInterval = 0
+	opts.LogLevel = "error"
+	s, err := New(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	enc := &frameEncoding{}
+	var handlers sync.WaitGroup
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		out := newChanWriter()
+		go func() {
+			writeBenchOutput(out)
+			out.closeWithExit(0)
+		}()
+		s.handleWriter(out, ws, s.startKeepalive(r.Context(), ws, 0), enc, &sessionLogger{id: "bench"})
+	}))
+	defer func() {
+		ts.Close()
+		handlers.Wait()
+	}()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	b.SetBytes(benchOutputSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	frames := 0
+	for i := 0; i < b.N; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				break
+			}
+			if message[0] == enc.prefix(stdoutChannel) {
+				frames++
+			}
+		}
+		ws.Close()
+	}
+	reportFramesPerMiB(b, frames)
+}
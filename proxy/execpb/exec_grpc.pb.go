@@ -0,0 +1,150 @@
+// Exec API served on -grpc-addr, the gRPC counterpart of the websocket exec endpoint.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: exec.proto
+
+package execpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	ExecService_Stream_FullMethodName = "/k8sproxy.v1.ExecService/Stream"
+)
+
+// ExecServiceClient is the client API for ExecService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ExecServiceClient interface {
+	// Stream runs a command in a container. The first request must be start; stdout, stderr and
+	// finally the exit status are streamed back. Errors before the command runs, and streams that
+	// fail, end the call with a gRPC status instead.
+	Stream(ctx context.Context, opts ...grpc.CallOption) (ExecService_StreamClient, error)
+}
+
+type execServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewExecServiceClient(cc grpc.ClientConnInterface) ExecServiceClient {
+	return &execServiceClient{cc}
+}
+
+func (c *execServiceClient) Stream(ctx context.Context, opts ...grpc.CallOption) (ExecService_StreamClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ExecService_ServiceDesc.Streams[0], ExecService_Stream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &execServiceStreamClient{ClientStream: stream}
+	return x, nil
+}
+
+type ExecService_StreamClient interface {
+	Send(*ExecRequest) error
+	Recv() (*ExecResponse, error)
+	grpc.ClientStream
+}
+
+type execServiceStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *execServiceStreamClient) Send(m *ExecRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *execServiceStreamClient) Recv() (*ExecResponse, error) {
+	m := new(ExecResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ExecServiceServer is the server API for ExecService service.
+// All implementations must embed UnimplementedExecServiceServer
+// for forward compatibility
+type ExecServiceServer interface {
+	// Stream runs a command in a container. The first request must be start; stdout, stderr and
+	// finally the exit status are streamed back. Errors before the command runs, and streams that
+	// fail, end the call with a gRPC status instead.
+	Stream(ExecService_StreamServer) error
+	mustEmbedUnimplementedExecServiceServer()
+}
+
+// UnimplementedExecServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedExecServiceServer struct {
+}
+
+func (UnimplementedExecServiceServer) Stream(ExecService_StreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
+}
+func (UnimplementedExecServiceServer) mustEmbedUnimplementedExecServiceServer() {}
+
+// UnsafeExecServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ExecServiceServer will
+// result in compilation errors.
+type UnsafeExecServiceServer interface {
+	mustEmbedUnimplementedExecServiceServer()
+}
+
+func RegisterExecServiceServer(s grpc.ServiceRegistrar, srv ExecServiceServer) {
+	s.RegisterService(&ExecService_ServiceDesc, srv)
+}
+
+func _ExecService_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ExecServiceServer).Stream(&execServiceStreamServer{ServerStream: stream})
+}
+
+type ExecService_StreamServer interface {
+	Send(*ExecResponse) error
+	Recv() (*ExecRequest, error)
+	grpc.ServerStream
+}
+
+type execServiceStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *execServiceStreamServer) Send(m *ExecResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *execServiceStreamServer) Recv() (*ExecRequest, error) {
+	m := new(ExecRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ExecService_ServiceDesc is the grpc.ServiceDesc for ExecService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ExecService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "k8sproxy.v1.ExecService",
+	HandlerType: (*ExecServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _ExecService_Stream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "exec.proto",
+}
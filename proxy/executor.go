@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+//executorFactory creates the executor streaming a request to the exec or attach subresource at url
+type executorFactory func(config *rest.Config, method string, url *url.URL) (remotecommand.Executor, error)
+
+//Executor backends selectable with -exec-backend
+var executorBackends = map[string]executorFactory{
+	"fallback":  newFallbackExecutor,
+	"websocket": newWebSocketExecutor,
+	"spdy":      remotecommand.NewSPDYExecutor,
+	"echo":      newEchoExecutor,
+}
+
+//executorBackend returns the executor factory named by -exec-backend, which creates the executors of
+//every exec, attach, cp, which and shell probe stream of a Server
+func executorBackend(name string) (executorFactory, error) {
+	factory, ok := executorBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid -exec-backend %q, must be fallback, websocket, spdy or echo", name)
+	}
+	return factory, nil
+}
+
+//newWebSocketExecutor streams over the API server's websocket protocol, which works through proxies and
+//HTTP/2 only ingresses that break SPDY upgrades. The upgrade is always a GET, whatever -exec-method says.
+func newWebSocketExecutor(config *rest.Config, _ string, url *url.URL) (remotecommand.Executor, error) {
+	return remotecommand.NewWebSocketExecutor(config, "GET", url.String())
+}
+
+//newFallbackExecutor tries the websocket protocol first and falls back to SPDY when the upgrade is
+//refused, as kubectl does, for API servers older than 1.30 and proxies rejecting websockets
+func newFallbackExecutor(config *rest.Config, method string, url *url.URL) (remotecommand.Executor, error) {
+	ws, err := newWebSocketExecutor(config, method, url)
+	if err != nil {
+		return nil, err
+	}
+	spdy, err := remotecommand.NewSPDYExecutor(config, method, url)
+	if err != nil {
+		return nil, err
+	}
+	return remotecommand.NewFallbackExecutor(ws, spdy, func(err error) bool {
+		if httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err) {
+			debugf("websocket exec refused, falling back to spdy: %v", err)
+			return true
+		}
+		return false
+	})
+}
+
+//echoExecutor is an in-memory stand-in for a container that echoes stdin back on stdout, as a terminal
+//in raw mode would. It lets clients and the ws protocol be exercised without reaching a cluster.
+type echoExecutor struct{}
+
+func newEchoExecutor(*rest.Config, string, *url.URL) (remotecommand.Executor, error) {
+	return echoExecutor{}, nil
+}
+
+func (e echoExecutor) Stream(options remotecommand.StreamOptions) error {
+	return e.StreamWithContext(context.Background(), options)
+}
+
+//StreamWithContext echoes until stdin ends, which exits with status 0, or ctx is done
+func (echoExecutor) StreamWithContext(ctx context.Context, options remotecommand.StreamOptions) error {
+	if options.TerminalSizeQueue != nil {
+		go func() {
+			for size := options.TerminalSizeQueue.Next(); size != nil; size = options.TerminalSizeQueue.Next() {
+				debugf("echo executor: resized to %dx%d", size.Width, size.Height)
+			}
+		}()
+	}
+	if options.Stdin == nil || options.Stdout == nil {
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var out io.Writer = options.Stdout
+		if options.Tty {
+			out = crlfWriter{out}
+		}
+		_, err := io.Copy(out, options.Stdin)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//crlfWriter turns the carriage returns a terminal sends for enter into line breaks
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\r"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
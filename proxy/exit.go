@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+//exitMessage is the payload of the exit frame, e.g. {"exitCode":1}
+type exitMessage struct {
+	ExitCode int `json:"exitCode"`
+}
+
+//exitCode extracts the exit status from the result of a stream. ok is false when
+//the stream failed for another reason than the command exiting non-zero.
+func exitCode(err error) (code int, ok bool) {
+	if err == nil {
+		return 0, true
+	}
+
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), true
+	}
+	return 0, false
+}
+
+//writeExitCode sends the "3"-prefixed exit frame
+func (s *Server) writeExitCode(ws *websocket.Conn, enc *frameEncoding, code int) error {
+	payload, err := enc.exitPayload(code)
+	if err != nil || payload == nil {
+		return err
+	}
+
+	ws.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+	return ws.WriteMessage(enc.frame(exitChannel, payload))
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefix of the environment variables setting flags, e.g. K8S_PROXY_READ_TIMEOUT for -read-timeout.
+const flagEnvPrefix = "K8S_PROXY_"
+
+//flagEnvName returns the environment variable setting the flag name
+func flagEnvName(name string) string {
+	return flagEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+//applyFlagEnv sets every flag of fs not given on the command line from its environment variable,
+//so command line flags win over the environment
+func applyFlagEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		name := flagEnvName(f.Name)
+		if v, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid %s %q: %v", name, v, setErr)
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Scheme of -addr values naming a unix socket to listen on.
+const unixScheme = "unix://"
+
+//parseTrustedProxies parses the comma separated -trusted-proxies list of CIDRs or single addresses,
+//the networks of reverse proxies whose X-Forwarded-* headers are believed
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -trusted-proxies entry %q: %v", entry, err)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+//trustedProxy reports whether ip belongs to one of the -trusted-proxies networks
+func (s *Server) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range s.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+//forwardedHeaders makes logs, limits and the same-origin check see the client instead of the reverse proxy
+//in front of the server: requests from -trusted-proxies, or any request over a unix socket, get their
+//remote address from X-Forwarded-For and their host from X-Forwarded-Host.
+func (s *Server) forwardedHeaders(next http.Handler) http.Handler {
+	unixSocket := strings.HasPrefix(s.opts.Addr, unixScheme)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !unixSocket && !s.trustedProxy(remoteIP(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.WithContext(r.Context())
+		if client := s.forwardedClient(r.Header.Values("X-Forwarded-For")); len(client) != 0 {
+			r.RemoteAddr = client
+		}
+		if host := r.Header.Get("X-Forwarded-Host"); len(host) != 0 {
+			//Proxies appending to the header list the original host first
+			r.Host = strings.TrimSpace(strings.Split(host, ",")[0])
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//forwardedClient returns the client address of an X-Forwarded-For chain: the last hop not added by a
+//trusted proxy, since anything before it may have been forged by the client
+func (s *Server) forwardedClient(values []string) string {
+	var hops []string
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); len(hop) != 0 {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i > 0; i-- {
+		if !s.trustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	if len(hops) != 0 {
+		return hops[0]
+	}
+	return ""
+}
+
+//stripBasePath serves next under -base-path, answering requests outside of it with 404
+func (s *Server) stripBasePath(next http.Handler) http.Handler {
+	if len(s.opts.BasePath) == 0 {
+		return next
+	}
+	return http.StripPrefix(s.opts.BasePath, next)
+}
+
+//listen opens the listener for -addr, a host:port or a unix:///path/to.sock socket. A stale socket
+//file left by a previous run is removed first.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixScheme) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, unixScheme)
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,438 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/scriptcoffee/k8s-proxy/proxy/execpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpckeepalive "google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+//go:generate protoc -I.. --go_out=.. --go_opt=module=github.com/scriptcoffee/k8s-proxy --go-grpc_out=.. --go-grpc_opt=module=github.com/scriptcoffee/k8s-proxy exec.proto
+
+//newGRPCServer serves ExecService over TLS when tlsConfig is set. Calls are authenticated by the same
+//middleware as HTTP requests, and their sessions are limited, authorized, audited and listed like ws ones.
+func (s *Server) newGRPCServer(tlsConfig *tls.Config, authenticate func(http.Handler) http.Handler) *grpc.Server {
+	//Held to -max-message-size like ws messages
+	opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(int(s.opts.MaxMessageSize))}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if s.opts.PingInterval > 0 {
+		opts = append(opts, grpc.KeepaliveParams(grpckeepalive.ServerParameters{Time: s.opts.PingInterval, Timeout: s.opts.PongTimeout}))
+	}
+
+	server := grpc.NewServer(opts...)
+	execpb.RegisterExecServiceServer(server, &execService{server: s, authenticate: authenticate})
+	return server
+}
+
+//execService implements ExecService of exec.proto
+type execService struct {
+	execpb.UnimplementedExecServiceServer
+	server       *Server
+	authenticate func(http.Handler) http.Handler
+}
+
+func (e *execService) Stream(stream execpb.ExecService_StreamServer) error {
+	return e.server.serveExecStream(stream, e.authenticate)
+}
+
+//grpcSession is the connection of a gRPC session in the sessions registry
+type grpcSession struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	err    error
+}
+
+//closeSession ends the call with reason, as the ws close code would end a ws session
+func (s *grpcSession) closeSession(code int, reason string) {
+	grpcCode := codes.Aborted
+	if code == websocket.CloseGoingAway {
+		grpcCode = codes.Unavailable
+	}
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = status.Error(grpcCode, reason)
+	}
+	s.mu.Unlock()
+	s.cancel()
+}
+
+func (s *grpcSession) Close() error {
+	s.closeSession(websocket.ClosePolicyViolation, "session closed")
+	return nil
+}
+
+//closeErr returns the status the session was closed with, nil when the client went away itself
+func (s *grpcSession) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+//grpcWriter sends what is written to it as stdout or stderr messages. Sends on a stream must not be
+//concurrent, so the writers of a stream share mu.
+type grpcWriter struct {
+	mu     *sync.Mutex
+	stream execpb.ExecService_StreamServer
+	stderr bool
+	logger *sessionLogger
+}
+
+func (w grpcWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	resp := &execpb.ExecResponse{Message: &execpb.ExecResponse_Stdout{Stdout: p}}
+	if w.stderr {
+		resp = &execpb.ExecResponse{Message: &execpb.ExecResponse_Stderr{Stderr: p}}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.stream.Send(resp); err != nil {
+		return 0, err
+	}
+	w.logger.countOut(len(p))
+	return len(p), nil
+}
+
+//serveExecStream runs an exec session for an ExecService.Stream call, following the exec endpoint
+func (s *Server) serveExecStream(stream execpb.ExecService_StreamServer, authenticate func(http.Handler) http.Handler) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	start := first.GetStart()
+	if start == nil {
+		return status.Error(codes.InvalidArgument, "the first message must be start")
+	}
+	if err := validateTarget(start.GetNamespace(), start.GetPod()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	size := remotecommand.TerminalSize{Width: defaultCols, Height: defaultRows}
+	requested, err := terminalSize(start.GetSize())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if requested.Width != 0 && requested.Height != 0 {
+		size = requested
+	}
+
+	r, err := s.grpcRequest(stream, start.GetCluster(), authenticate)
+	if err != nil {
+		return err
+	}
+	release, code, err := s.reserveSession(r)
+	if err != nil {
+		return status.Error(grpcCode(code), err.Error())
+	}
+	defer release()
+
+	opts := &execOptions{
+		namespace:     start.GetNamespace(),
+		podName:       start.GetPod(),
+		containerName: start.GetContainer(),
+		command:       start.GetCommand(),
+		env:           start.GetEnv(),
+		cwd:           start.GetCwd(),
+		tty:           start.GetTty(),
+		stdin:         start.GetStdin(),
+		limiter:       newStdinLimiter(s.opts.StdinRate),
+		size:          size,
+	}
+	if len(opts.containerName) == 0 {
+		var client kubernetes.Interface
+		client, err = s.requestClient(r)
+		if err == nil {
+			opts.containerName, err = defaultContainer(r.Context(), client, opts.namespace, opts.podName)
+		}
+		if err != nil {
+			return status.Error(grpcCode(statusForError(err)), err.Error())
+		}
+	}
+
+	logger := s.newSessionLogger(r, "grpc-exec", opts.namespace, opts.podName, opts.containerName)
+	stream.SendHeader(metadata.Pairs(strings.ToLower(sessionIDHeader), logger.id))
+	defer sessionStarted("grpc-exec", opts.namespace)()
+
+	commands, err := s.execSessionCommand(r, "exec", opts)
+	if err != nil {
+		logger.ended(fmt.Sprintf("rejected: %v", err))
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	logger.record.Command = commands
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	conn := &grpcSession{cancel: cancel}
+	if !s.sessions.add(conn, logger) {
+		logger.ended("rejected: server draining")
+		return status.Error(codes.Unavailable, "server draining")
+	}
+	defer s.sessions.remove(conn)
+
+	req := s.newExecRequest(s.requestCluster(r).clientset, opts.namespace, opts.podName, opts.containerName, commands, opts.stdin, opts.tty)
+	executor, err := s.newExecutor(s.requestConfig(r), s.opts.ExecMethod, req.URL())
+	if err != nil {
+		logger.errorf("creating executor: %v", err)
+		logger.ended("stream failed")
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	sendMu := &sync.Mutex{}
+	stdout := grpcWriter{mu: sendMu, stream: stream, logger: logger}
+	stderr := grpcWriter{mu: sendMu, stream: stream, stderr: true, logger: logger}
+	sio, err := s.newSessionIO(logger, opts, stdout, stderr)
+	if err != nil {
+		logger.errorf("%v", err)
+		logger.ended("stream failed")
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer sio.close()
+	defer s.limitDuration(logger, stderr)()
+
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		s.receiveExecStream(ctx, cancel, stream, sio, opts, stderr, logger)
+	}()
+	//Nothing touches the session once the handler returns
+	defer func() { <-received }()
+
+	logger.infof("session started endpoint=grpc-exec command=%q tty=%t stdin=%t", commands, opts.tty, opts.stdin)
+	events := s.startSessionEvents(s.requestCluster(r).clientset, opts.namespace, opts.podName, opts.containerName, s.eventIdentity(r))
+
+	err = executor.StreamWithContext(ctx, sio.streamOptions(opts.tty))
+	clientGone := ctx.Err() != nil
+	cancel()
+	events.end(err)
+	sio.end(err)
+
+	if clientGone {
+		if closeErr := conn.closeErr(); closeErr != nil {
+			logger.ended(status.Convert(closeErr).Message())
+			return closeErr
+		}
+		logger.ended("client disconnected")
+		return status.FromContextError(r.Context().Err()).Err()
+	}
+
+	exit, ok := exitCode(err)
+	if !ok {
+		streamErrors.WithLabelValues("grpc-exec").Inc()
+		logger.errorf("stream: %v", err)
+		logger.ended("stream failed")
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	logger.ended(fmt.Sprintf("command exited exitCode=%d", exit))
+	sendMu.Lock()
+	defer sendMu.Unlock()
+	return stream.Send(&execpb.ExecResponse{Message: &execpb.ExecResponse_Exit{Exit: &execpb.Exit{Code: int32(exit)}}})
+}
+
+//terminalSize converts a TerminalSize message, zero when it is nil
+func terminalSize(size *execpb.TerminalSize) (remotecommand.TerminalSize, error) {
+	if size.GetCols() > 0xffff || size.GetRows() > 0xffff {
+		return remotecommand.TerminalSize{}, errors.New("terminal size out of range")
+	}
+	return remotecommand.TerminalSize{Width: uint16(size.GetCols()), Height: uint16(size.GetRows())}, nil
+}
+
+//execRequests receives the messages of stream. Recv only returns once the call ends, after the handler
+//returned, so receiving runs apart from the session and stops at the first error or once done is closed.
+func execRequests(stream execpb.ExecService_StreamServer, done <-chan struct{}) <-chan execRequest {
+	requests := make(chan execRequest)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			select {
+			case requests <- execRequest{msg, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return requests
+}
+
+//execRequest is a message received by execRequests, or the error ending the call
+type execRequest struct {
+	msg *execpb.ExecRequest
+	err error
+}
+
+//receiveExecStream passes stdin and resize messages on to the session until the client half-closes
+//the call, which ends stdin, it fails, which cancels the session, or the session ends
+func (s *Server) receiveExecStream(ctx context.Context, cancel context.CancelFunc, stream execpb.ExecService_StreamServer, sio *sessionIO, opts *execOptions, warn io.Writer, logger *sessionLogger) {
+	requests := execRequests(stream, ctx.Done())
+	for {
+		var req execRequest
+		select {
+		case req = <-requests:
+		case <-ctx.Done():
+			return
+		}
+		msg, err := req.msg, req.err
+		if err == io.EOF {
+			if sio.dp != nil {
+				sio.dp.Close()
+			}
+			return
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.debugf("receive: %v", err)
+			}
+			cancel()
+			return
+		}
+
+		switch {
+		case msg.GetResize() != nil:
+			size, err := terminalSize(msg.GetResize())
+			if err != nil {
+				logger.debugf("resize: %v", err)
+			} else if size.Width != 0 && size.Height != 0 {
+				logger.debugf("resize cols=%d rows=%d", size.Width, size.Height)
+				sio.sizes.push(size)
+			}
+		case msg.GetCloseStdin():
+			if sio.dp != nil {
+				logger.debugf("stdin closed by client")
+				sio.dp.Close()
+			}
+		case len(msg.GetStdin()) != 0 && sio.dp != nil:
+			n, err := s.receiveLimited(ctx, sio.dp, msg.GetStdin(), opts.limiter)
+			logger.countIn(n)
+			if errors.Is(err, errStdinStalled) {
+				dropped := len(msg.GetStdin()) - n
+				stdinDropped.Add(float64(dropped))
+				logger.infof("stdin: container not reading, dropped %d bytes", dropped)
+				fmt.Fprintf(warn, "\r\n[k8s-proxy: container not reading stdin, %d bytes dropped]\r\n", dropped)
+			} else if err != nil && ctx.Err() == nil {
+				//Stdin was closed, further input has nowhere to go
+				logger.debugf("stdin: %v", err)
+			}
+		}
+	}
+}
+
+//grpcRequest describes the call as an HTTP request carrying its metadata as headers, run through
+//authenticate so the identity, impersonation and limits apply as for HTTP clients. The request is
+//routed to cluster, the default one when empty.
+func (s *Server) grpcRequest(stream grpc.ServerStream, cluster string, authenticate func(http.Handler) http.Handler) (*http.Request, error) {
+	ctx := stream.Context()
+	c, ok := s.clusters.defaultCluster(), true
+	if len(cluster) != 0 {
+		c, ok = s.clusters.get(cluster)
+	}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown cluster %q", cluster)
+	}
+
+	r, err := http.NewRequestWithContext(context.WithValue(ctx, clusterKey{}, c), http.MethodPost, execpb.ExecService_Stream_FullMethodName, nil)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		//Pseudo headers and binary values have no HTTP counterpart
+		if strings.HasPrefix(key, ":") || strings.HasSuffix(key, "-bin") {
+			continue
+		}
+		for _, v := range values {
+			r.Header.Add(key, v)
+		}
+	}
+	if authority := md.Get(":authority"); len(authority) != 0 {
+		r.Host = authority[0]
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	var authenticated *http.Request
+	rejection := &rejectionRecorder{header: http.Header{}, status: http.StatusOK}
+	authenticate(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		authenticated = r
+	})).ServeHTTP(rejection, r)
+	if authenticated == nil {
+		return nil, status.Error(grpcCode(rejection.status), rejection.message())
+	}
+	return authenticated, nil
+}
+
+//rejectionRecorder keeps the error response authentication middleware writes for a gRPC call
+type rejectionRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *rejectionRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *rejectionRecorder) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *rejectionRecorder) WriteHeader(status int) {
+	w.status = status
+}
+
+//message returns the error of the httpError JSON body, or the body itself
+func (w *rejectionRecorder) message() string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(w.body.Bytes(), &body) == nil && len(body.Error) != 0 {
+		return body.Error
+	}
+	return strings.TrimSpace(w.body.String())
+}
+
+//grpcCode maps the HTTP status a request would be rejected with to a gRPC status code
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
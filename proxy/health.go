@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Time allowed for the readiness check against the API server.
+	readyTimeout = 3 * time.Second
+
+	// How long a readiness result is reused before the API server is checked again.
+	readyCacheTTL = 5 * time.Second
+)
+
+//readinessCache holds the result of the last API server check so frequent probes don't hammer it
+type readinessCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+//serveHealthz reports the process is up
+func (s *Server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+//serveReadyz reports whether the Kubernetes API server is reachable with the proxy's credentials
+func (s *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := s.checkAPIServer(); err != nil {
+		httpError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (s *Server) checkAPIServer() error {
+	s.readiness.mu.Lock()
+	defer s.readiness.mu.Unlock()
+
+	if time.Since(s.readiness.checked) < readyCacheTTL {
+		return s.readiness.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+
+	//Fetching the server version fails on both unreachable API servers and rejected credentials
+	s.readiness.err = s.clusters.defaultCluster().clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+	s.readiness.checked = time.Now()
+	return s.readiness.err
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"k8s.io/client-go/rest"
+)
+
+const (
+	remoteUserHeader  = "X-Remote-User"
+	remoteGroupHeader = "X-Remote-Group"
+)
+
+//requestConfig returns the rest config to reach the API server with on behalf of r.
+//With -impersonate-authenticated it is a copy of userConfig(r) impersonating the user authenticated by OIDC,
+//with -enable-impersonation and an X-Remote-User header one impersonating that user and any X-Remote-Group
+//groups, otherwise userConfig(r) itself. With tracing the config is a traced copy. The shared config is never mutated.
+func (s *Server) requestConfig(r *http.Request) *rest.Config {
+	return tracedConfig(s.impersonatedConfig(r))
+}
+
+//impersonatedConfig is requestConfig without tracing
+func (s *Server) impersonatedConfig(r *http.Request) *rest.Config {
+	base := s.userConfig(r)
+	if s.opts.ImpersonateAuthenticated {
+		id := requestIdentity(r)
+		if id == nil {
+			return base
+		}
+		impersonated := rest.CopyConfig(base)
+		impersonated.Impersonate = rest.ImpersonationConfig{UserName: id.user, Groups: id.groups}
+		return impersonated
+	}
+	if !s.opts.EnableImpersonation {
+		return base
+	}
+	user := strings.TrimSpace(r.Header.Get(remoteUserHeader))
+	if len(user) == 0 {
+		return base
+	}
+
+	var groups []string
+	for _, v := range r.Header.Values(remoteGroupHeader) {
+		for _, group := range strings.Split(v, ",") {
+			if group = strings.TrimSpace(group); len(group) != 0 {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	impersonated := rest.CopyConfig(base)
+	impersonated.Impersonate = rest.ImpersonationConfig{UserName: user, Groups: groups}
+	return impersonated
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	b64 "encoding/base64"
+
+	"github.com/gorilla/websocket"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/remotecommand"
+)
+
+// Kubernetes exec subprotocols, so clients written for the API server can use the proxy directly.
+// The base64 variants frame channels exactly like the proxy's own protocol, the others use binary
+// frames prefixed with the channel number. v4 and later report the exit status as a metav1.Status.
+const (
+	v5ChannelProtocol       = remotecommand.StreamProtocolV5Name
+	v4ChannelProtocol       = remotecommand.StreamProtocolV4Name
+	v4Base64ChannelProtocol = "v4.base64.channel.k8s.io"
+	v1ChannelProtocol       = remotecommand.StreamProtocolV1Name
+	v1Base64ChannelProtocol = "base64.channel.k8s.io"
+)
+
+// Sent by v5 clients once they are done with a stream, carrying the stream number as data.
+const closeChannel = remotecommand.StreamClose
+
+//Subprotocols accepted during the upgrade, most preferred first
+var k8sSubprotocols = []string{
+	v5ChannelProtocol,
+	v4ChannelProtocol,
+	v4Base64ChannelProtocol,
+	v1ChannelProtocol,
+	v1Base64ChannelProtocol,
+}
+
+//negotiatedSubprotocol returns the subprotocol the upgrade will select, the first of
+//k8sSubprotocols offered by the client, or an empty string
+func negotiatedSubprotocol(r *http.Request) string {
+	offered := websocket.Subprotocols(r)
+	for _, protocol := range k8sSubprotocols {
+		for _, o := range offered {
+			if o == protocol {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
+
+//k8sEncoding returns the frame encoding of protocol
+func k8sEncoding(protocol string) *frameEncoding {
+	enc := &frameEncoding{protocol: protocol}
+	if protocol == v4Base64ChannelProtocol || protocol == v1Base64ChannelProtocol {
+		enc.b64 = b64.StdEncoding
+	}
+	return enc
+}
+
+//prefix returns the first byte of a binary frame on channel. The Kubernetes protocols use the
+//channel number rather than its ASCII digit.
+func (e *frameEncoding) prefix(channel byte) byte {
+	if len(e.protocol) != 0 {
+		return channel - stdinChannel
+	}
+	return channel
+}
+
+//channel maps the first byte of a received frame back to one of the channel constants
+func (e *frameEncoding) channel(prefix byte) byte {
+	if len(e.protocol) != 0 && e.b64 == nil && prefix < 10 {
+		return prefix + stdinChannel
+	}
+	return prefix
+}
+
+//exitPayload returns the payload of the frame reporting the command's exit code on the exit channel,
+//or nil when the protocol doesn't report success
+func (e *frameEncoding) exitPayload(code int) ([]byte, error) {
+	switch e.protocol {
+	case "":
+		return json.Marshal(exitMessage{ExitCode: code})
+	case v1ChannelProtocol, v1Base64ChannelProtocol:
+		if code == 0 {
+			return nil, nil
+		}
+		return []byte(fmt.Sprintf("command terminated with non-zero exit code: %d", code)), nil
+	}
+
+	if code == 0 {
+		return json.Marshal(metav1.Status{Status: metav1.StatusSuccess})
+	}
+	return json.Marshal(metav1.Status{
+		Status:  metav1.StatusFailure,
+		Reason:  remotecommand.NonZeroExitCodeReason,
+		Message: fmt.Sprintf("command terminated with non-zero exit code: %d", code),
+		Details: &metav1.StatusDetails{
+			Causes: []metav1.StatusCause{{Type: remotecommand.ExitCodeCauseType, Message: strconv.Itoa(code)}},
+		},
+	})
+}
+
+//errorPayload returns the payload of the frame reporting a failed stream on the exit channel,
+//or nil for the proxy's own protocol which only reports it in the close message
+func (e *frameEncoding) errorPayload(err error) ([]byte, error) {
+	switch e.protocol {
+	case "":
+		return nil, nil
+	case v1ChannelProtocol, v1Base64ChannelProtocol:
+		return []byte(err.Error()), nil
+	}
+	return json.Marshal(metav1.Status{Status: metav1.StatusFailure, Message: err.Error()})
+}
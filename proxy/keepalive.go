@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//keepalive pings the ws peer every -ping-interval and owns the read deadline of a session, which
+//expires once the client sent nothing for idleTimeout (0 for never) or a pong is overdue
+type keepalive struct {
+	mu          sync.Mutex
+	ws          *websocket.Conn
+	ctx         context.Context
+	idleTimeout time.Duration
+	pongWait    time.Duration
+	lastInput   time.Time
+	lastPong    time.Time
+}
+
+//startKeepalive sets the initial read deadline of ws and starts pinging it until ctx is done
+func (s *Server) startKeepalive(ctx context.Context, ws *websocket.Conn, idleTimeout time.Duration) *keepalive {
+	now := time.Now()
+	k := &keepalive{ws: ws, ctx: ctx, idleTimeout: idleTimeout, lastInput: now, lastPong: now}
+	if s.opts.PingInterval > 0 {
+		k.pongWait = s.opts.PingInterval + s.opts.PongTimeout
+	}
+
+	//Pong handlers run inside the session's ReadMessage, so load balancers see traffic both ways
+	ws.SetPongHandler(func(string) error {
+		k.mu.Lock()
+		k.lastPong = time.Now()
+		k.mu.Unlock()
+		k.extend()
+		return nil
+	})
+	//The goroutine may outlive the session's handler for a moment, so it is given the settings it needs
+	if s.opts.PingInterval > 0 {
+		go k.ping(s.opts.PingInterval, s.opts.WriteTimeout)
+	}
+	k.extend()
+	return k
+}
+
+func (k *keepalive) ping(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		//WriteControl is safe to call concurrently with the session's writer
+		if err := k.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+			return
+		}
+	}
+}
+
+//activity records that the client is in use, pushing back the idle timeout
+func (k *keepalive) activity() {
+	k.mu.Lock()
+	k.lastInput = time.Now()
+	k.mu.Unlock()
+	k.extend()
+}
+
+//extend moves the read deadline to the earlier of the idle timeout and the pong deadline
+func (k *keepalive) extend() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var deadline time.Time
+	if k.idleTimeout > 0 {
+		deadline = k.lastInput.Add(k.idleTimeout)
+	}
+	if k.pongWait > 0 {
+		pongDeadline := k.lastPong.Add(k.pongWait)
+		if deadline.IsZero() || pongDeadline.Before(deadline) {
+			deadline = pongDeadline
+		}
+	}
+
+	//Never push back the deadline expire set to unblock the reader
+	if k.ctx.Err() != nil {
+		return
+	}
+	k.ws.SetReadDeadline(deadline)
+}
+
+//expire unblocks a pending read once the session is over
+func (k *keepalive) expire() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.ws.SetReadDeadline(time.Now())
+}
+
+//idle reports whether a read deadline was hit because the client was inactive rather than unresponsive
+func (k *keepalive) idle() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.idleTimeout > 0 && time.Since(k.lastInput) >= k.idleTimeout
+}
+
+//requestIdleTimeout returns the inactivity timeout asked for with the idleTimeout param,
+//defaulting to -read-timeout and bounded by -max-read-timeout
+func (s *Server) requestIdleTimeout(vals url.Values) (time.Duration, error) {
+	v := vals.Get("idleTimeout")
+	if len(v) == 0 {
+		return s.opts.ReadTimeout, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid idleTimeout %q", v)
+	}
+	if d > s.opts.MaxReadTimeout {
+		return 0, fmt.Errorf("idleTimeout %s exceeds the maximum of %s", d, s.opts.MaxReadTimeout)
+	}
+	return d, nil
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+//loadConfig resolves the Kubernetes client config. The in-cluster service account is used when
+//forced, or when no kubeconfig was given and the default one doesn't exist; otherwise the
+//kubeconfig file is loaded.
+func loadConfig(kubeconfig string, explicit, forceInCluster bool) (*rest.Config, error) {
+	if forceInCluster {
+		cfg, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("loading in-cluster config: %v", err)
+		}
+		return cfg, nil
+	}
+
+	if !explicit {
+		if _, err := os.Stat(kubeconfig); kubeconfig == "" || os.IsNotExist(err) {
+			cfg, inClusterErr := rest.InClusterConfig()
+			if inClusterErr == nil {
+				return cfg, nil
+			}
+			return nil, fmt.Errorf("no kubeconfig found at %q and in-cluster config unavailable: %v", kubeconfig, inClusterErr)
+		}
+	}
+
+	// use the current context in kubeconfig
+	cfg, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("loading kubeconfig %q: %v", kubeconfig, err)
+	}
+	return cfg, nil
+}
+
+//loadDefaultCluster loads the cluster of requests naming none, as loadConfig resolves it
+func loadDefaultCluster(kubeconfig string, explicit, forceInCluster bool) (*cluster, error) {
+	cfg, err := loadConfig(kubeconfig, explicit, forceInCluster)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &cluster{config: cfg, clientset: cs}, nil
+}
+
+//kubeconfigReloader loads the clusters from the kubeconfig, loading them again on SIGHUP or when the
+//file changes so rotated credentials embedded in it are used by new sessions. Credentials client-go
+//refreshes by itself, from exec plugins or token files, need no reload.
+type kubeconfigReloader struct {
+	clusters  *clusterSet
+	path      string
+	explicit  bool
+	inCluster bool
+	contexts  string
+	modTime   time.Time
+}
+
+//watch reloads the clusters on SIGHUP and, with a positive interval, whenever polling finds the kubeconfig
+//changed, until ctx is done
+func (k *kubeconfigReloader) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		//Without polling the tick channel stays nil, leaving only SIGHUP
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			case <-tick:
+				if !k.changed() {
+					continue
+				}
+			}
+			if err := k.load(); err != nil {
+				errorf("kubeconfig: keeping previous config, reload failed: %v", err)
+				continue
+			}
+			infof("kubeconfig: reloaded %s", k.path)
+		}
+	}()
+}
+
+//load builds every cluster before replacing any, so a broken kubeconfig leaves the previous ones in use
+func (k *kubeconfigReloader) load() error {
+	modTime := k.latestModTime()
+	def, err := loadDefaultCluster(k.path, k.explicit, k.inCluster)
+	if err != nil {
+		return err
+	}
+	named, err := loadClusters(k.path, k.contexts)
+	if err != nil {
+		return err
+	}
+	k.clusters.set(def, named)
+	k.modTime = modTime
+	return nil
+}
+
+//latestModTime returns the kubeconfig's modification time, following symlinks as secret volumes use
+func (k *kubeconfigReloader) latestModTime() time.Time {
+	if info, err := os.Stat(k.path); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+func (k *kubeconfigReloader) changed() bool {
+	return !k.latestModTime().Equal(k.modTime)
+}
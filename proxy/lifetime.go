@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Close reason of sessions ended by -max-session-duration.
+const maxDurationReason = "maximum session duration reached"
+
+//limitDuration ends the session logged by logger once it ran for -max-session-duration, however active it
+//is, telling the client through warn -session-end-warning beforehand. warn may be nil for sessions without
+//a text channel. The returned func stops the timers once the session ended on its own.
+func (s *Server) limitDuration(logger *sessionLogger, warn io.Writer) func() {
+	if s.opts.MaxSessionDuration <= 0 {
+		return func() {}
+	}
+	deadline := logger.start.Add(s.opts.MaxSessionDuration)
+
+	var warning *time.Timer
+	if warn != nil && s.opts.SessionEndWarning > 0 && s.opts.SessionEndWarning < s.opts.MaxSessionDuration {
+		warning = time.AfterFunc(time.Until(deadline.Add(-s.opts.SessionEndWarning)), func() {
+			logger.infof("session ends in %s, maximum duration %s", s.opts.SessionEndWarning, s.opts.MaxSessionDuration)
+			fmt.Fprintf(warn, "\r\n[k8s-proxy: maximum session duration of %s, this session ends in %s]\r\n", s.opts.MaxSessionDuration, s.opts.SessionEndWarning)
+		})
+	}
+	end := time.AfterFunc(time.Until(deadline), func() {
+		s.sessions.kill(logger.id, maxDurationReason)
+	})
+
+	return func() {
+		if warning != nil {
+			warning.Stop()
+		}
+		end.Stop()
+	}
+}
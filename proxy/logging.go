@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelError
+)
+
+var logLevels = map[string]int{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"error": levelError,
+}
+
+var levelNames = map[int]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelError: "error",
+}
+
+//Minimum level written to the log, set from the -log-level flag. Atomic since New may set it while
+//the goroutines of a previous Server's sessions still log.
+var minLogLevel int32 = levelInfo
+
+//Query params that may carry credentials and are never logged
+var sensitiveParams = []string{"token", "access_token", "authorization"}
+
+//setLogLevel sets the minimum level written to the log
+func setLogLevel(name string) error {
+	level, ok := logLevels[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown log level %q, must be debug, info or error", name)
+	}
+	atomic.StoreInt32(&minLogLevel, int32(level))
+	return nil
+}
+
+//Whether log lines are written as JSON objects, set from the -log-format flag, 1 for JSON
+var logJSON int32
+
+//setLogFormat selects key=value text or JSON log lines
+func setLogFormat(name string) error {
+	switch name {
+	case "text":
+		atomic.StoreInt32(&logJSON, 0)
+	case "json":
+		atomic.StoreInt32(&logJSON, 1)
+	default:
+		return fmt.Errorf("unknown log format %q, must be text or json", name)
+	}
+	return nil
+}
+
+//logField is a key and value added to a log line
+type logField struct {
+	key   string
+	value interface{}
+}
+
+//logf writes a log line with fields when level is enabled
+func logf(level int, fields []logField, format string, v ...interface{}) {
+	if int32(level) < atomic.LoadInt32(&minLogLevel) {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+
+	if atomic.LoadInt32(&logJSON) == 1 {
+		//Built by hand to keep the fields in order, json.Marshal sorts map keys
+		var b bytes.Buffer
+		b.WriteString(`{"time":`)
+		writeJSONValue(&b, time.Now().UTC().Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSONValue(&b, levelNames[level])
+		for _, f := range fields {
+			b.WriteByte(',')
+			writeJSONValue(&b, f.key)
+			b.WriteByte(':')
+			writeJSONValue(&b, f.value)
+		}
+		b.WriteString(`,"msg":`)
+		writeJSONValue(&b, msg)
+		b.WriteString("}\n")
+		log.Writer().Write(b.Bytes())
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "level=%s", levelNames[level])
+	for _, f := range fields {
+		value := fmt.Sprint(f.value)
+		if len(value) == 0 || strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", f.key, value)
+	}
+	log.Printf("%s msg=%q", b.String(), msg)
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+//debugf logs at debug level
+func debugf(format string, v ...interface{}) {
+	logf(levelDebug, nil, format, v...)
+}
+
+//infof logs at info level
+func infof(format string, v ...interface{}) {
+	logf(levelInfo, nil, format, v...)
+}
+
+//errorf logs at error level
+func errorf(format string, v ...interface{}) {
+	logf(levelError, nil, format, v...)
+}
+
+//sessionLogger tags every line of a ws session with its ID, target and remote address,
+//and collects the session's audit record and byte counts
+type sessionLogger struct {
+	//Accessed atomically, first so they stay 64-bit aligned on 32-bit platforms
+	bytesIn      int64
+	bytesOut     int64
+	lastActivity int64
+
+	//Bytes read and written on the wire by compressed ws connections
+	wireIn  int64
+	wireOut int64
+
+	id     string
+	start  time.Time
+	fields []logField
+	record AuditRecord
+
+	//Who opened the session, as requestUser names it. Empty for anonymous requests.
+	owner string
+
+	//Where the audit record goes once the session ends, from -audit-log and the Audit option
+	audit     *auditLog
+	auditHook func(AuditRecord)
+}
+
+//requestUserInfo returns the user and groups behind r: the impersonated user is who the API server sees,
+//otherwise the authenticated one. The user is empty when neither is known.
+func (s *Server) requestUserInfo(r *http.Request) (string, []string) {
+	impersonate := s.requestConfig(r).Impersonate
+	if id := requestIdentity(r); id != nil && len(impersonate.UserName) == 0 {
+		return id.user, id.groups
+	}
+	return impersonate.UserName, impersonate.Groups
+}
+
+func (s *Server) newSessionLogger(r *http.Request, endpoint, namespace, podName, containerName string) *sessionLogger {
+	id := newSessionID()
+	fields := []logField{
+		{"session", id},
+		{"endpoint", endpoint},
+		{"namespace", namespace},
+		{"pod", podName},
+		{"container", containerName},
+		{"remote", r.RemoteAddr},
+	}
+	cluster := s.requestCluster(r).name
+	if len(cluster) != 0 {
+		fields = append(fields, logField{"cluster", cluster})
+	}
+	user, groups := s.requestUserInfo(r)
+	if len(user) != 0 {
+		fields = append(fields, logField{"user", user})
+	}
+	start := time.Now()
+	return &sessionLogger{
+		lastActivity: start.UnixNano(),
+		id:           id,
+		start:        start,
+		fields:       fields,
+		owner:        s.requestUser(r),
+		audit:        s.audit,
+		auditHook:    s.opts.Audit,
+		record: AuditRecord{
+			Session:    id,
+			Endpoint:   endpoint,
+			Cluster:    cluster,
+			User:       user,
+			Groups:     groups,
+			RemoteAddr: r.RemoteAddr,
+			Namespace:  namespace,
+			Pod:        podName,
+			Container:  containerName,
+			Start:      start,
+		},
+	}
+}
+
+//newSessionID returns a short random ID to correlate the log lines of a session
+func newSessionID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+func (l *sessionLogger) debugf(format string, v ...interface{}) {
+	logf(levelDebug, l.fields, format, v...)
+}
+
+func (l *sessionLogger) infof(format string, v ...interface{}) {
+	logf(levelInfo, l.fields, format, v...)
+}
+
+func (l *sessionLogger) errorf(format string, v ...interface{}) {
+	logf(levelError, l.fields, format, v...)
+}
+
+//countIn records n bytes received from the client
+func (l *sessionLogger) countIn(n int) {
+	atomic.AddInt64(&l.bytesIn, int64(n))
+	atomic.StoreInt64(&l.lastActivity, time.Now().UnixNano())
+	bytesProxied.WithLabelValues("in").Add(float64(n))
+}
+
+//countOut records n bytes sent to the client
+func (l *sessionLogger) countOut(n int) {
+	atomic.AddInt64(&l.bytesOut, int64(n))
+	atomic.StoreInt64(&l.lastActivity, time.Now().UnixNano())
+	bytesProxied.WithLabelValues("out").Add(float64(n))
+}
+
+//idle returns the time since data last went through the session
+func (l *sessionLogger) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&l.lastActivity)))
+}
+
+//ended logs the end of the session with its duration and writes its audit record
+func (l *sessionLogger) ended(reason string) {
+	l.infof("session ended: %s duration=%s bytesIn=%d bytesOut=%d", reason, time.Since(l.start).Round(time.Millisecond),
+		atomic.LoadInt64(&l.bytesIn), atomic.LoadInt64(&l.bytesOut))
+	if l.audit == nil && l.auditHook == nil {
+		return
+	}
+	l.record.End = time.Now()
+	l.record.Reason = reason
+	l.record.BytesIn = atomic.LoadInt64(&l.bytesIn)
+	l.record.BytesOut = atomic.LoadInt64(&l.bytesOut)
+	if l.audit != nil {
+		l.audit.record(&l.record)
+	}
+	if l.auditHook != nil {
+		l.auditHook(l.record)
+	}
+}
+
+//redactURL renders u without user info or credential carrying query params
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+
+	query := redacted.Query()
+	for _, key := range sensitiveParams {
+		for k := range query {
+			if strings.EqualFold(k, key) {
+				query.Set(k, "REDACTED")
+			}
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+//logOptions holds the validated parameters of a log session
+type logOptions struct {
+	namespace     string
+	podName       string
+	containerName string
+	allContainers bool
+	prefix        string
+	follow        bool
+	timestamps    bool
+	tailLines     *int64
+	sinceSeconds  *int64
+}
+
+//parseLogOptions validates the log request without writing to the response
+func parseLogOptions(r *http.Request) (*logOptions, error) {
+	params := mux.Vars(r)
+	vals := r.URL.Query()
+	opts := &logOptions{
+		namespace:     params["namespace"],
+		podName:       params["podName"],
+		containerName: vals.Get("container"),
+		allContainers: vals.Get("allContainers") != "false",
+		prefix:        vals.Get("prefix"),
+		follow:        true,
+	}
+
+	if err := validateTarget(opts.namespace, opts.podName); err != nil {
+		return nil, err
+	}
+
+	for name, dst := range map[string]*bool{"follow": &opts.follow, "timestamps": &opts.timestamps} {
+		if v := vals.Get(name); len(v) != 0 {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = b
+		}
+	}
+
+	for name, dst := range map[string]**int64{"tailLines": &opts.tailLines, "sinceSeconds": &opts.sinceSeconds} {
+		if v := vals.Get(name); len(v) != 0 {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = &n
+		}
+	}
+	return opts, nil
+}
+
+//logContainers resolves which containers to follow. Without an explicit container the
+//default-container annotation or the only container is used, and multi-container pods
+//follow every container unless allContainers is false.
+func logContainers(ctx context.Context, client kubernetes.Interface, opts *logOptions) ([]string, error) {
+	if len(opts.containerName) != 0 {
+		return []string{opts.containerName}, nil
+	}
+
+	pod, err := client.CoreV1().Pods(opts.namespace).Get(ctx, opts.podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if name := pod.Annotations[defaultContainerAnnotation]; len(name) != 0 && !opts.allContainers {
+		return []string{name}, nil
+	}
+	if len(pod.Spec.Containers) == 1 {
+		return []string{pod.Spec.Containers[0].Name}, nil
+	}
+	if !opts.allContainers {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("pod %s/%s has %d containers, a container must be specified", opts.namespace, opts.podName, len(pod.Spec.Containers)))
+	}
+
+	names := make([]string, 0, len(pod.Spec.Containers))
+	for _, c := range pod.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	return names, nil
+}
+
+//serveLogs follows container logs over ws using the same "1"-prefixed base64 framing as exec.
+//Multiple containers are merged with a per-container line prefix.
+func (s *Server) serveLogs(w http.ResponseWriter, r *http.Request) {
+	guard := &responseGuard{ResponseWriter: w}
+	release, ok := s.admitSession(guard, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	opts, err := parseLogOptions(r)
+	if err != nil {
+		httpError(guard, http.StatusBadRequest, err.Error())
+		return
+	}
+	enc, err := s.requestEncoding(r)
+	if err != nil {
+		httpError(guard, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	client, err := s.requestClient(r)
+	if err != nil {
+		httpError(guard, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	containers, err := logContainers(r.Context(), client, opts)
+	if err != nil {
+		httpError(guard, statusForError(err), err.Error())
+		return
+	}
+	//Logs reveal what containers print, so each is checked and authorized like a session reaching it
+	for _, container := range containers {
+		err = s.policy.checkTarget(r.Context(), s.requestCluster(r).clientset, opts.namespace, opts.podName, container)
+		if err == nil {
+			err = s.authorize(r, "log", opts.namespace, opts.podName, container, nil)
+		}
+		if err != nil {
+			httpError(guard, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+
+	logger := s.newSessionLogger(r, "log", opts.namespace, opts.podName, strings.Join(containers, ","))
+
+	ws, err := s.upgradeWs(guard, r, logger, nil)
+	if err != nil {
+		logger.errorf("upgrade: %v", err)
+		upgradeFailures.Inc()
+		return
+	}
+	defer ws.Close()
+	defer sessionStarted("log", opts.namespace)()
+
+	if !s.sessions.add(ws, logger) {
+		logger.ended("rejected: server draining")
+		s.errToWs(ws, websocket.CloseTryAgainLater, "server draining")
+		return
+	}
+	defer s.sessions.remove(ws)
+
+	//Closing the ws cancels the log streams so no API connection is left open
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//Log clients never send, so only unanswered pings end the session from this side
+	k := s.startKeepalive(ctx, ws, 0)
+	go func() {
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	writer := newChanWriter()
+	writerDone := make(chan struct{})
+	go func() {
+		s.handleWriter(writer, ws, k, enc, logger)
+		close(writerDone)
+	}()
+
+	logger.infof("log session started")
+	var wg sync.WaitGroup
+	errs := make(chan error, len(containers))
+	for _, container := range containers {
+		wg.Add(1)
+		go func(container string) {
+			defer wg.Done()
+			if err := streamLogs(ctx, client, opts, container, writer, len(containers) > 1); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(container)
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		streamErrors.WithLabelValues("log").Inc()
+		logger.errorf("log stream: %v", err)
+		logger.ended("stream failed")
+		writer.closeWithError(err)
+	} else {
+		logger.ended("stream closed")
+		writer.Close()
+	}
+	<-writerDone
+}
+
+//streamLogs copies the log stream of one container to w. Streams with a prefix, which merged streams
+//always have, are copied a line at a time so lines from different containers don't interleave.
+func streamLogs(ctx context.Context, client kubernetes.Interface, opts *logOptions, container string, w io.Writer, merged bool) error {
+	req := client.CoreV1().Pods(opts.namespace).GetLogs(opts.podName, &corev1.PodLogOptions{
+		Container:    container,
+		Follow:       opts.follow,
+		Timestamps:   opts.timestamps,
+		TailLines:    opts.tailLines,
+		SinceSeconds: opts.sinceSeconds,
+	})
+
+	stream, err := req.Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	template := opts.prefix
+	if len(template) == 0 && merged {
+		template = defaultLinePrefix
+	}
+	if len(template) == 0 {
+		_, err = io.Copy(w, stream)
+	} else {
+		prefix := expandPrefix(template, opts.namespace, opts.podName, container)
+		reader := bufio.NewReader(stream)
+		for err == nil {
+			var line []byte
+			line, err = reader.ReadBytes('\n')
+			if len(line) != 0 {
+				if _, werr := w.Write(append([]byte(prefix), line...)); werr != nil {
+					return werr
+				}
+			}
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+
+	//The client going away is not a stream failure
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"k8s.io/client-go/rest"
+)
+
+//readLogs opens a log session of web-0 with the params in query and returns the decoded stdout once it closes,
+//or the handshake status when it is rejected
+func readLogs(t *testing.T, ts *httptest.Server, query string) (int, string) {
+	t.Helper()
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/v1/namespaces/default/pods/web-0/log?follow=false" + query
+	dialer := websocket.Dialer{HandshakeTimeout: 5 * time.Second}
+	ws, resp, err := dialer.Dial(u, nil)
+	if err != nil {
+		if resp == nil {
+			t.Fatalf("dial: %v", err)
+		}
+		return resp.StatusCode, ""
+	}
+	defer ws.Close()
+
+	var out []byte
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Fatalf("got %v, want a normal close", err)
+			}
+			return resp.StatusCode, string(out)
+		}
+		if len(msg) == 0 || msg[0] != '1' {
+			t.Fatalf("got frame %q, want stdout", msg)
+		}
+		data, err := base64.StdEncoding.DecodeString(string(msg[1:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, data...)
+	}
+}
+
+func TestLogsCheckEveryContainer(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		policy string
+		query  string
+		status int
+	}{
+		{"all containers allowed", `containers: ["app", "db"]`, "", http.StatusSwitchingProtocols},
+		{"one of the merged containers denied", `containers: ["app"]`, "", http.StatusForbidden},
+		{"explicit container denied", `containers: ["app"]`, "&container=db", http.StatusForbidden},
+		{"explicit container allowed", `containers: ["app"]`, "&container=app", http.StatusSwitchingProtocols},
+		{"pod denied", `pods: ["db-*"]`, "&container=app", http.StatusForbidden},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			api := newPodAPI(t, testPod("app", "db"))
+			ts := newTestServer(t, func(o *Options) {
+				o.RESTConfig = &rest.Config{Host: api}
+				o.PolicyFile = writePolicy(t, test.policy)
+			})
+			if status, _ := readLogs(t, ts, test.query); status != test.status {
+				t.Errorf("got status %d, want %d", status, test.status)
+			}
+		})
+	}
+}
+
+func TestLogsAuthzWebhook(t *testing.T) {
+	inputs := make(chan authzInput, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input authzInput `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		inputs <- body.Input
+		w.Write([]byte(`{"result": {"allow": ` + map[bool]string{true: "true", false: "false"}[body.Input.Container == "app"] + `}}`))
+	}))
+	defer webhook.Close()
+	api := newPodAPI(t, testPod("app", "db"))
+	ts := newTestServer(t, func(o *Options) {
+		o.RESTConfig = &rest.Config{Host: api}
+		o.AuthzWebhookURL = webhook.URL
+	})
+
+	if status, out := readLogs(t, ts, "&container=app"); status != http.StatusSwitchingProtocols || out != "log of app\n" {
+		t.Errorf("allowed container: got status %d and %q", status, out)
+	}
+	if input := <-inputs; input.Endpoint != "log" || input.Container != "app" {
+		t.Errorf("webhook got %+v, want the log endpoint and container", input)
+	}
+	if status, _ := readLogs(t, ts, ""); status != http.StatusForbidden {
+		t.Errorf("merged containers with one denied: got status %d, want 403", status)
+	}
+}
+
+func TestLogsPrefix(t *testing.T) {
+	api := newPodAPI(t, testPod("app"))
+	ts := newTestServer(t, func(o *Options) { o.RESTConfig = &rest.Config{Host: api} })
+
+	for query, want := range map[string]string{
+		"": "log of app\n",
+		"&prefix=" + url.QueryEscape("{namespace}/{container}: "): "default/app: log of app\n",
+	} {
+		if _, out := readLogs(t, ts, query); out != want {
+			t.Errorf("%q: got %q, want %q", query, out, want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+//Registered on the default registry so the Go runtime and process metrics are exported too
+var (
+	sessionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8s_proxy_sessions_active",
+		Help: "Number of websocket sessions currently open.",
+	})
+
+	sessionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_proxy_sessions_total",
+		Help: "Total number of websocket sessions opened.",
+	}, []string{"endpoint", "namespace"})
+
+	sessionsEnded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_proxy_sessions_ended_total",
+		Help: "Total number of websocket sessions closed.",
+	}, []string{"endpoint"})
+
+	bytesProxied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_proxy_bytes_total",
+		Help: "Total number of payload bytes proxied, in from ws clients or out to them.",
+	}, []string{"direction"})
+
+	upgradeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_proxy_upgrade_failures_total",
+		Help: "Total number of failed websocket upgrades.",
+	})
+
+	streamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_proxy_stream_errors_total",
+		Help: "Total number of stream errors, by the stream that failed.",
+	}, []string{"stream"})
+
+	sessionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "k8s_proxy_session_duration_seconds",
+		Help:    "Duration of websocket sessions from upgrade to close.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	})
+
+	stdinDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_proxy_stdin_dropped_bytes_total",
+		Help: "Total number of stdin bytes dropped because the container didn't read them within -stdin-stall-timeout.",
+	})
+
+	authzDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_proxy_authz_decisions_total",
+		Help: "Total number of authorization webhook decisions, by allow, deny or error.",
+	}, []string{"decision"})
+)
+
+//sessionStarted records a session opened on endpoint, returning the func to call when it closes
+func sessionStarted(endpoint, namespace string) func() {
+	start := time.Now()
+	sessionsActive.Inc()
+	sessionsTotal.WithLabelValues(endpoint, namespace).Inc()
+
+	return func() {
+		sessionsActive.Dec()
+		sessionsEnded.WithLabelValues(endpoint).Inc()
+		sessionDuration.Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Path observers of a shared session connect to, followed by the share token.
+const sharedPathPrefix = "/shared/"
+
+//observerHub copies the output of an exec or attach session to read-only observers
+type observerHub struct {
+	mu        sync.Mutex
+	registry  *observerRegistry
+	logger    *sessionLogger
+	observers map[*chanWriter]bool
+	tokens    []string
+	ended     bool
+}
+
+//observerRegistry indexes the hubs of live sessions by session ID and share token
+type observerRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*observerHub
+	tokens   map[string]*observerHub
+}
+
+func newObserverRegistry() *observerRegistry {
+	return &observerRegistry{
+		sessions: make(map[string]*observerHub),
+		tokens:   make(map[string]*observerHub),
+	}
+}
+
+//newHub registers a hub for the session logged by logger, shareable until end is called
+func (o *observerRegistry) newHub(logger *sessionLogger) *observerHub {
+	h := &observerHub{registry: o, logger: logger, observers: make(map[*chanWriter]bool)}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.sessions[logger.id] = h
+	return h
+}
+
+//hub returns the hub of the live session with id, or nil when there is none
+func (o *observerRegistry) hub(id string) *observerHub {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.sessions[id]
+}
+
+//share returns a new token observers of the session of h can join with, or an empty one when it ended
+func (o *observerRegistry) share(h *observerHub) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.sessions[h.logger.id] != h {
+		return "", nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	o.tokens[token] = h
+	h.tokens = append(h.tokens, token)
+	return token, nil
+}
+
+//revoke invalidates the share tokens of the session with id and disconnects its observers, as its
+//stream may take a while to stop once the session is killed
+func (o *observerRegistry) revoke(id, reason string) {
+	o.mu.Lock()
+	h := o.sessions[id]
+	if h != nil {
+		for _, token := range h.tokens {
+			delete(o.tokens, token)
+		}
+		h.tokens = nil
+	}
+	o.mu.Unlock()
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.observers {
+		delete(h.observers, w)
+		w.closeWithError(errors.New(reason))
+	}
+}
+
+func (o *observerRegistry) get(token string) *observerHub {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.tokens[token]
+}
+
+//output returns a writer passing output on to w and copying it to the observers on channel
+func (h *observerHub) output(w io.Writer, channel byte) io.Writer {
+	return observedWriter{w: w, h: h, channel: channel}
+}
+
+type observedWriter struct {
+	w       io.Writer
+	h       *observerHub
+	channel byte
+}
+
+func (o observedWriter) Write(p []byte) (int, error) {
+	o.h.broadcast(o.channel, p)
+	return o.w.Write(p)
+}
+
+//broadcast sends p to every observer. Observers that fall behind are disconnected rather than
+//slowing down the session.
+func (h *observerHub) broadcast(channel byte, p []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.observers {
+		if !w.trySend(channel, p) {
+			delete(h.observers, w)
+			w.closeWithError(errors.New("observer fell behind"))
+		}
+	}
+}
+
+//join adds w as an observer, returning false once the session has ended
+func (h *observerHub) join(w *chanWriter) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.ended {
+		return false
+	}
+	h.observers[w] = true
+	return true
+}
+
+func (h *observerHub) leave(w *chanWriter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.observers, w)
+}
+
+//end unregisters the hub and reports the outcome of the stream to the observers
+func (h *observerHub) end(err error) {
+	o := h.registry
+	o.mu.Lock()
+	delete(o.sessions, h.logger.id)
+	for _, token := range h.tokens {
+		delete(o.tokens, token)
+	}
+	o.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.ended = true
+	code, ok := exitCode(err)
+	for w := range h.observers {
+		if ok {
+			w.closeWithExit(code)
+		} else {
+			w.closeWithError(err)
+		}
+	}
+	h.observers = nil
+}
+
+//shareResponse is the JSON body returned when a session is shared
+type shareResponse struct {
+	Token string `json:"token"`
+	Path  string `json:"path"`
+}
+
+//serveShareSession creates a token letting observers watch a live exec or attach session. Only
+//the user who opened the session and admins may share it.
+func (s *Server) serveShareSession(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	h := s.observed.hub(id)
+	if h == nil {
+		httpError(w, http.StatusNotFound, "no shareable session "+id)
+		return
+	}
+	if owner := h.logger.owner; !s.isAdmin(r) && (len(owner) == 0 || s.requestUser(r) != owner) {
+		httpError(w, http.StatusForbidden, "only the user who opened the session or an admin may share it")
+		return
+	}
+	token, err := s.observed.share(h)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(token) == 0 {
+		httpError(w, http.StatusNotFound, "no shareable session "+id)
+		return
+	}
+	h.logger.infof("session shared")
+	writeJSON(w, http.StatusCreated, shareResponse{Token: token, Path: s.opts.BasePath + sharedPathPrefix + token})
+}
+
+//serveObserver streams the output of a shared session to a read-only ws. Frames from the
+//observer are discarded.
+func (s *Server) serveObserver(w http.ResponseWriter, r *http.Request) {
+	guard := &responseGuard{ResponseWriter: w}
+	release, ok := s.admitSession(guard, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	h := s.observed.get(mux.Vars(r)["token"])
+	if h == nil {
+		httpError(guard, http.StatusNotFound, "no such shared session")
+		return
+	}
+	enc, err := s.requestEncoding(r)
+	if err != nil {
+		httpError(guard, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//Observers are sessions of their own, so what they received is accounted and audited apart
+	watched := h.logger.record
+	logger := s.newSessionLogger(r, "observe", watched.Namespace, watched.Pod, watched.Container)
+	logger.fields = append(logger.fields, logField{"observing", h.logger.id})
+	logger.record.Command = watched.Command
+
+	ws, err := s.upgradeWs(guard, r, logger, nil)
+	if err != nil {
+		logger.errorf("upgrade: %v", err)
+		upgradeFailures.Inc()
+		return
+	}
+	defer ws.Close()
+
+	//Registered like any session, so observers are counted, listed, drained and can be killed
+	if !s.sessions.add(ws, logger) {
+		logger.ended("rejected: server draining")
+		s.errToWs(ws, websocket.CloseTryAgainLater, "server draining")
+		return
+	}
+	defer s.sessions.remove(ws)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//Observers never send, so only unanswered pings end the connection from this side
+	k := s.startKeepalive(ctx, ws, 0)
+
+	writer := newChanWriter()
+	if !h.join(writer) {
+		logger.ended("rejected: session ended")
+		s.errToWs(ws, websocket.CloseNormalClosure, "session ended")
+		return
+	}
+	defer h.leave(writer)
+	h.logger.infof("observer joined session=%s remote=%s", logger.id, r.RemoteAddr)
+
+	writerDone := make(chan struct{})
+	go func() {
+		s.handleWriter(writer, ws, k, enc, logger)
+		close(writerDone)
+	}()
+
+	clientGone := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				close(clientGone)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-clientGone:
+		logger.ended("client disconnected")
+		writer.Close()
+	case <-writerDone:
+		logger.ended("observed session ended")
+	}
+	<-writerDone
+}
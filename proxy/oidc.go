@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Time allowed for each request to the OIDC issuer.
+	oidcFetchTimeout = 10 * time.Second
+
+	// Age after which the issuer's signing keys are fetched again.
+	oidcKeysMaxAge = time.Hour
+
+	// Shortest interval between attempts to fetch the keys again, failed or not.
+	oidcKeysMinRefresh = time.Minute
+
+	// Clock skew tolerated on exp and nbf.
+	oidcLeeway = time.Minute
+)
+
+//identity is the authenticated user behind a request
+type identity struct {
+	user   string
+	groups []string
+}
+
+//identityKey is the request context key holding the identity of an authenticated request
+type identityKey struct{}
+
+//requestIdentity returns the identity authenticated for r, or nil when no authenticator set one
+func requestIdentity(r *http.Request) *identity {
+	id, _ := r.Context().Value(identityKey{}).(*identity)
+	return id
+}
+
+//oidcVerifier checks OIDC ID tokens against the issuer's published signing keys
+type oidcVerifier struct {
+	issuer        string
+	clientID      string
+	usernameClaim string
+	groupsClaim   string
+	jwksURL       string
+	client        *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	//Set when a fetch starts, whether it succeeds or not
+	attemptedAt time.Time
+}
+
+//newOIDCVerifier discovers the issuer's JWKS endpoint and fetches its keys
+func newOIDCVerifier(issuer, clientID, usernameClaim, groupsClaim string) (*oidcVerifier, error) {
+	if len(clientID) == 0 {
+		return nil, errors.New("-oidc-client-id is required with -oidc-issuer-url")
+	}
+	v := &oidcVerifier{
+		issuer:        strings.TrimSuffix(issuer, "/"),
+		clientID:      clientID,
+		usernameClaim: usernameClaim,
+		groupsClaim:   groupsClaim,
+		client:        &http.Client{Timeout: oidcFetchTimeout},
+	}
+
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %v", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != v.issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q doesn't match -oidc-issuer-url %q", discovery.Issuer, issuer)
+	}
+	v.jwksURL = discovery.JWKSURI
+
+	if err := v.refresh(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *oidcVerifier) getJSON(url string, dst interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+//jsonWebKey is a public key of a JWKS document, RSA or EC
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//refresh replaces the cached keys with the issuer's current ones. Callers hold no lock.
+func (v *oidcVerifier) refresh() error {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(v.jwksURL, &jwks); err != nil {
+		return fmt.Errorf("oidc keys: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			errorf("oidc: skipping key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("oidc keys: no usable signing key")
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+//candidateKeys returns the key with kid, or every key when the token names none. Unknown kids and
+//stale caches trigger a refresh, rate limited by the last attempt so bogus tokens can't hammer the
+//issuer, even while it is failing.
+func (v *oidcVerifier) candidateKeys(kid string) []crypto.PublicKey {
+	v.mu.Lock()
+	_, known := v.keys[kid]
+	stale := time.Since(v.fetchedAt) > oidcKeysMaxAge || (!known && len(kid) != 0)
+	fetch := stale && time.Since(v.attemptedAt) > oidcKeysMinRefresh
+	if fetch {
+		v.attemptedAt = time.Now()
+	}
+	v.mu.Unlock()
+
+	if fetch {
+		if err := v.refresh(); err != nil {
+			errorf("%v, keeping previous keys", err)
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(kid) != 0 {
+		if key, ok := v.keys[kid]; ok {
+			return []crypto.PublicKey{key}
+		}
+		return nil
+	}
+	keys := make([]crypto.PublicKey, 0, len(v.keys))
+	for _, key := range v.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+//verify checks the signature, issuer, audience and validity period of the ID token raw,
+//returning the identity in its claims
+func (v *oidcVerifier) verify(raw string) (*identity, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("token signature: %v", err)
+	}
+
+	verified := false
+	for _, key := range v.candidateKeys(header.Kid) {
+		if verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("token claims: %v", err)
+	}
+	return v.checkClaims(claims)
+}
+
+func decodeSegment(segment string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+//verifySignature checks signature over signed with key for the RS and ES algorithms issuers use
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(alg) != len("RS256") {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(key, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+//checkClaims validates the registered claims and extracts the user and groups
+func (v *oidcVerifier) checkClaims(claims map[string]interface{}) (*identity, error) {
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+		return nil, fmt.Errorf("token issued by %q", iss)
+	}
+	if !containsString(stringList(claims["aud"]), v.clientID) {
+		return nil, errors.New("token not issued for this client")
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+
+	user, _ := claims[v.usernameClaim].(string)
+	if len(user) == 0 {
+		return nil, fmt.Errorf("token has no %s claim", v.usernameClaim)
+	}
+	//As the API server does, unverified addresses can't be used as user names
+	if v.usernameClaim == "email" {
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return nil, errors.New("token email is not verified")
+		}
+	}
+	return &identity{user: user, groups: stringList(claims[v.groupsClaim])}, nil
+}
+
+//stringList reads a claim holding either a string or a list of strings
+func stringList(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		list := make([]string, 0, len(claim))
+		for _, v := range claim {
+			if s, ok := v.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//requireOIDC rejects requests without a valid ID token with 401, before any upgrade happens,
+//and stores the identity of the others in the request context
+func requireOIDC(v *oidcVerifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := requestToken(r)
+		var id *identity
+		err := errors.New("no token")
+		if len(token) != 0 {
+			_, span := tracer.Start(r.Context(), "authenticate")
+			id, err = v.verify(token)
+			endSpan(span, err)
+		}
+		if err != nil {
+			debugf("oidc: rejected request from %s: %v", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
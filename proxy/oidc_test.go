@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//newTestIssuer serves OIDC discovery and a JWKS document with one EC key, failing key fetches while
+//failing is set. It returns the issuer URL and the number of key fetches.
+func newTestIssuer(t *testing.T, failing *atomic.Bool) (string, *int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int64
+	var issuer string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			writeJSON(w, http.StatusOK, map[string]string{"issuer": issuer, "jwks_uri": issuer + "/keys"})
+		case "/keys":
+			atomic.AddInt64(&fetches, 1)
+			if failing.Load() {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string][]jsonWebKey{"keys": {{
+				Kty: "EC",
+				Kid: "k1",
+				Crv: "P-256",
+				X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+				Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	issuer = ts.URL
+	return issuer, &fetches
+}
+
+func TestOIDCKeyRefetchesAreRateLimited(t *testing.T) {
+	var failing atomic.Bool
+	issuer, fetches := newTestIssuer(t, &failing)
+	v, err := newOIDCVerifier(issuer, "proxy", "sub", "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Unknown kids refetch once, then wait for the next minute
+	v.attemptedAt = time.Now().Add(-2 * oidcKeysMinRefresh)
+	for i := 0; i < 5; i++ {
+		v.candidateKeys("unknown")
+	}
+	if n := atomic.LoadInt64(fetches); n != 2 {
+		t.Errorf("unknown kids: got %d fetches, want 2", n)
+	}
+
+	//A failing issuer leaves the keys stale, which must not refetch on every token
+	failing.Store(true)
+	v.fetchedAt = time.Now().Add(-2 * oidcKeysMaxAge)
+	v.attemptedAt = time.Now().Add(-2 * oidcKeysMinRefresh)
+	for i := 0; i < 5; i++ {
+		if keys := v.candidateKeys("k1"); len(keys) != 1 {
+			t.Fatalf("got %d keys, want the previous key kept", len(keys))
+		}
+	}
+	if n := atomic.LoadInt64(fetches); n != 3 {
+		t.Errorf("failing issuer: got %d fetches, want 3", n)
+	}
+}
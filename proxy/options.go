@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"flag"
+	"net/http"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+//Options configures a Server. Each setting is also a flag, named after the field in lowercase words
+//separated by dashes, e.g. MaxSessionsPerIP is -max-sessions-per-ip, and described by its usage.
+type Options struct {
+	Config                   string
+	ValidateConfig           bool
+	Addr                     string
+	BasePath                 string
+	GRPCAddr                 string
+	TrustedProxies           string
+	Compression              bool
+	CompressionLevel         int
+	ExecMethod               string
+	ExecBackend              string
+	StdinRate                int
+	EmitK8sEvents            bool
+	LogLevel                 string
+	LogFormat                string
+	OutputKeepalive          bool
+	OutputFlushInterval      time.Duration
+	StdinBuffer              int
+	StdinStallTimeout        time.Duration
+	InCluster                bool
+	Kubeconfig               string
+	KubeconfigReloadInterval time.Duration
+	TLSCert                  string
+	TLSKey                   string
+	TLSMinVersion            string
+	AllowedOrigins           string
+	MaxSessionDuration       time.Duration
+	SessionEndWarning        time.Duration
+	OTLPEndpoint             string
+	OTLPInsecure             bool
+	TraceSampleRatio         float64
+	ShutdownTimeout          time.Duration
+	OIDCIssuerURL            string
+	OIDCClientID             string
+	OIDCUsernameClaim        string
+	OIDCGroupsClaim          string
+	AuthTokenFile            string
+	AdminTokenFile           string
+	OIDCAdminGroup           string
+	MaxSessions              int
+	MaxSessionsPerIP         int
+	MaxSessionsPerUser       int
+	UpgradeRate              float64
+	UpgradeBurst             int
+	AuthzWebhookURL          string
+	AuthzWebhookTimeout      time.Duration
+	PolicyFile               string
+	Base64                   string
+	MaxUploadSize            int64
+	DebugImages              string
+	DebugProfiles            string
+	Shells                   string
+	AllowedCommands          string
+	PassThroughToken         bool
+	AuditLog                 string
+	AuditWebhook             string
+	RecordDir                string
+	RecordNamespaces         string
+	ResumeWindow             time.Duration
+	DetachTimeout            time.Duration
+	Scrollback               int
+	RecordStdin              bool
+	Clusters                 string
+	ImpersonateAuthenticated bool
+	EnableImpersonation      bool
+	WriteTimeout             time.Duration
+	MaxMessageSize           int64
+	ReadTimeout              time.Duration
+	MaxReadTimeout           time.Duration
+	PingInterval             time.Duration
+	PongTimeout              time.Duration
+	CloseGrace               time.Duration
+
+	//RESTConfig, when set, is the config of the default cluster instead of the one loaded from Kubeconfig
+	//or the in-cluster service account. It is never reloaded.
+	RESTConfig *rest.Config
+
+	//Authenticate, when set, authenticates every request the flags' own authentication let through,
+	//returning the user and groups making it. An error rejects the request with 401.
+	Authenticate func(r *http.Request) (user string, groups []string, err error)
+
+	//Audit, when set, receives the audit record of every session as it ends, along with -audit-log and
+	//-audit-webhook
+	Audit func(record AuditRecord)
+}
+
+//DefaultOptions returns the settings of a Server given no flags
+func DefaultOptions() Options {
+	return Options{
+		Addr:                     "127.0.0.1:8888",
+		CompressionLevel:         1,
+		ExecMethod:               http.MethodPost,
+		ExecBackend:              "fallback",
+		LogLevel:                 "info",
+		LogFormat:                "text",
+		KubeconfigReloadInterval: 30 * time.Second,
+		TLSMinVersion:            "1.2",
+		SessionEndWarning:        5 * time.Minute,
+		TraceSampleRatio:         1,
+		ShutdownTimeout:          30 * time.Second,
+		OIDCUsernameClaim:        "sub",
+		OIDCGroupsClaim:          "groups",
+		UpgradeBurst:             10,
+		AuthzWebhookTimeout:      5 * time.Second,
+		Base64:                   "std",
+		MaxUploadSize:            1 << 30,
+		DebugProfiles:            "general,baseline,restricted",
+		Scrollback:               64 * 1024,
+		WriteTimeout:             10 * time.Second,
+		MaxMessageSize:           8192,
+		ReadTimeout:              5 * time.Minute,
+		MaxReadTimeout:           time.Hour,
+		PingInterval:             30 * time.Second,
+		PongTimeout:              10 * time.Second,
+		CloseGrace:               10 * time.Second,
+	}
+}
+
+//RegisterFlags defines a flag for every setting on fs, defaulting to the current values of o
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Config, "config", o.Config, "YAML or JSON file of settings keyed by flag name, overridden by the environment and command line")
+	fs.BoolVar(&o.ValidateConfig, "validate-config", o.ValidateConfig, "check the configuration, kubeconfig and the files it names, then exit with status 1 on errors or 0")
+	fs.StringVar(&o.Addr, "addr", o.Addr, "http service address, host:port or unix:///path/to.sock for a unix socket")
+	fs.StringVar(&o.BasePath, "base-path", o.BasePath, "path prefix every route is served under, e.g. /terminal behind a proxy routing by path. Served at / when empty")
+	fs.StringVar(&o.GRPCAddr, "grpc-addr", o.GRPCAddr, "address of a second listener serving the gRPC ExecService of exec.proto, host:port or unix:///path/to.sock. Disabled when empty")
+	fs.StringVar(&o.TrustedProxies, "trusted-proxies", o.TrustedProxies, "comma separated addresses or CIDRs of reverse proxies whose X-Forwarded-For and X-Forwarded-Host headers are believed. Peers of a unix socket -addr are always trusted")
+	fs.BoolVar(&o.Compression, "compression", o.Compression, "negotiate per-message deflate compression with ws clients")
+	fs.IntVar(&o.CompressionLevel, "compression-level", o.CompressionLevel, "deflate level of compressed ws messages, from 1 for the fastest to 9 for the smallest")
+	fs.StringVar(&o.ExecMethod, "exec-method", o.ExecMethod, "HTTP method used for the exec subresource: POST or GET")
+	fs.StringVar(&o.ExecBackend, "exec-backend", o.ExecBackend, "how exec and attach streams reach containers: websocket, spdy, fallback to try websocket then spdy, or echo to answer every session with an in-memory echo for testing clients")
+	fs.IntVar(&o.StdinRate, "stdin-rate", o.StdinRate, "maximum stdin bytes per second forwarded per session, 0 for unlimited")
+	fs.BoolVar(&o.EmitK8sEvents, "emit-k8s-events", o.EmitK8sEvents, "record exec session start and end as Events on the target pod")
+	fs.StringVar(&o.LogLevel, "log-level", o.LogLevel, "minimum log level: debug, info or error")
+	fs.StringVar(&o.LogFormat, "log-format", o.LogFormat, "log line format: text for key=value lines or json")
+	fs.BoolVar(&o.OutputKeepalive, "output-keepalive", o.OutputKeepalive, "treat container output as activity so output-only sessions aren't closed for inactivity")
+	fs.DurationVar(&o.OutputFlushInterval, "output-flush-interval", o.OutputFlushInterval, "time to wait for more container output to batch into one frame, 0 to only batch output that is already buffered")
+	fs.IntVar(&o.StdinBuffer, "stdin-buffer", o.StdinBuffer, "size in bytes of a ring buffer for stdin, 0 to use an unbuffered pipe")
+	fs.DurationVar(&o.StdinStallTimeout, "stdin-stall-timeout", o.StdinStallTimeout, "time stdin may wait for the container to read a full -stdin-buffer before the rest of the frame is dropped with a warning, 0 to wait forever")
+	fs.BoolVar(&o.InCluster, "in-cluster", o.InCluster, "use the pod service account instead of a kubeconfig file")
+	fs.StringVar(&o.Kubeconfig, "kubeconfig", o.Kubeconfig, "absolute path to the kubeconfig file, ~/.kube/execConfig when empty")
+	fs.DurationVar(&o.KubeconfigReloadInterval, "kubeconfig-reload-interval", o.KubeconfigReloadInterval, "how often the kubeconfig is checked for changes and reloaded for new sessions, also reloaded on SIGHUP. 0 to only reload on SIGHUP")
+	fs.StringVar(&o.TLSCert, "tls-cert", o.TLSCert, "certificate file for serving wss, requires -tls-key")
+	fs.StringVar(&o.TLSKey, "tls-key", o.TLSKey, "private key file for serving wss, requires -tls-cert")
+	fs.StringVar(&o.TLSMinVersion, "tls-min-version", o.TLSMinVersion, "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.StringVar(&o.AllowedOrigins, "allowed-origins", o.AllowedOrigins, "comma separated origins allowed to open ws sessions and make CORS requests, with globs such as https://*.example.com, * for any, same-origin when empty")
+	fs.DurationVar(&o.MaxSessionDuration, "max-session-duration", o.MaxSessionDuration, "time after which sessions are ended however active they are, e.g. 4h, 0 for unlimited")
+	fs.DurationVar(&o.SessionEndWarning, "session-end-warning", o.SessionEndWarning, "time before -max-session-duration ends a session that its client is warned on stderr, 0 for no warning")
+	fs.StringVar(&o.OTLPEndpoint, "otlp-endpoint", o.OTLPEndpoint, "host:port of an OTLP/HTTP collector to export traces of requests and sessions to, e.g. otel-collector:4318. Tracing is disabled when empty")
+	fs.BoolVar(&o.OTLPInsecure, "otlp-insecure", o.OTLPInsecure, "export traces over plain HTTP instead of HTTPS")
+	fs.Float64Var(&o.TraceSampleRatio, "trace-sample-ratio", o.TraceSampleRatio, "fraction of traces sampled when the client sent no sampling decision, from 0 to 1")
+	fs.DurationVar(&o.ShutdownTimeout, "shutdown-timeout", o.ShutdownTimeout, "time allowed for sessions to drain on SIGINT or SIGTERM")
+	fs.StringVar(&o.OIDCIssuerURL, "oidc-issuer-url", o.OIDCIssuerURL, "OIDC issuer whose ID tokens authenticate requests, e.g. https://accounts.example.com. OIDC is disabled when empty")
+	fs.StringVar(&o.OIDCClientID, "oidc-client-id", o.OIDCClientID, "client ID ID tokens must be issued for, checked against their aud claim")
+	fs.StringVar(&o.OIDCUsernameClaim, "oidc-username-claim", o.OIDCUsernameClaim, "ID token claim holding the user name")
+	fs.StringVar(&o.OIDCGroupsClaim, "oidc-groups-claim", o.OIDCGroupsClaim, "ID token claim holding the user's groups")
+	fs.StringVar(&o.AuthTokenFile, "auth-token-file", o.AuthTokenFile, "file of valid bearer tokens, one per line, reloaded on SIGHUP. Auth is disabled when empty")
+	fs.StringVar(&o.AdminTokenFile, "admin-token-file", o.AdminTokenFile, "file of bearer tokens allowed to use the /admin routes, one per line, reloaded on SIGHUP")
+	fs.StringVar(&o.OIDCAdminGroup, "oidc-admin-group", o.OIDCAdminGroup, "group whose members, as authenticated by -oidc-issuer-url, may use the /admin routes")
+	fs.IntVar(&o.MaxSessions, "max-sessions", o.MaxSessions, "maximum number of concurrent ws sessions, 0 for unlimited")
+	fs.IntVar(&o.MaxSessionsPerIP, "max-sessions-per-ip", o.MaxSessionsPerIP, "maximum number of concurrent ws sessions per remote address, 0 for unlimited")
+	fs.IntVar(&o.MaxSessionsPerUser, "max-sessions-per-user", o.MaxSessionsPerUser, "maximum number of concurrent ws sessions per user or bearer token, 0 for unlimited")
+	fs.Float64Var(&o.UpgradeRate, "upgrade-rate", o.UpgradeRate, "sustained ws sessions per second each remote address and each user may open, 0 for unlimited")
+	fs.IntVar(&o.UpgradeBurst, "upgrade-burst", o.UpgradeBurst, "ws sessions a remote address or user may open at once before -upgrade-rate applies")
+	fs.StringVar(&o.AuthzWebhookURL, "authz-webhook-url", o.AuthzWebhookURL, "URL every session is POSTed to for an allow or deny decision before it starts, e.g. an OPA data API path. Disabled when empty")
+	fs.DurationVar(&o.AuthzWebhookTimeout, "authz-webhook-timeout", o.AuthzWebhookTimeout, "time allowed for an -authz-webhook-url decision, sessions are denied when it runs out")
+	fs.StringVar(&o.PolicyFile, "policy-file", o.PolicyFile, "YAML or JSON policy restricting namespaces, pods and commands, reloaded on SIGHUP")
+	fs.StringVar(&o.Base64, "base64", o.Base64, "default base64 variant for ws frames: std, url, rawstd or rawurl")
+	fs.Int64Var(&o.MaxUploadSize, "max-upload-size", o.MaxUploadSize, "maximum size in bytes of a cp upload request, 0 for unlimited")
+	fs.StringVar(&o.DebugImages, "debug-images", o.DebugImages, "comma separated image globs the debug endpoint may start as ephemeral containers, e.g. busybox:*,nicolaka/netshoot:*. The endpoint is disabled when empty")
+	fs.StringVar(&o.DebugProfiles, "debug-profiles", o.DebugProfiles, "comma separated kubectl debug profiles clients may pick: legacy, general, baseline, restricted, netadmin, sysadmin")
+	fs.StringVar(&o.Shells, "shells", o.Shells, "comma separated shells probed in order for sessions without a command, using the first found in the container, e.g. /bin/bash,/bin/sh,/bin/ash,cmd.exe. /bin/sh -i when empty")
+	fs.StringVar(&o.AllowedCommands, "allowed-commands", o.AllowedCommands, "comma separated binaries sessions may run, e.g. /bin/sh,/bin/bash. Any binary when empty")
+	fs.BoolVar(&o.PassThroughToken, "pass-through-token", o.PassThroughToken, "call the API server with the client's bearer token instead of the kubeconfig credentials")
+	fs.StringVar(&o.AuditLog, "audit-log", o.AuditLog, "file to append a JSON audit record of every ws session to, - for stdout")
+	fs.StringVar(&o.AuditWebhook, "audit-webhook", o.AuditWebhook, "URL each JSON audit record is POSTed to")
+	fs.StringVar(&o.RecordDir, "record-dir", o.RecordDir, "directory to write asciicast v2 recordings of exec and attach sessions to, recording is disabled when empty")
+	fs.StringVar(&o.RecordNamespaces, "record-namespaces", o.RecordNamespaces, "comma separated namespace globs whose sessions are recorded, all when empty")
+	fs.DurationVar(&o.ResumeWindow, "resume-window", o.ResumeWindow, "time exec and attach sessions survive a lost connection, for the client to resume them with the token of the X-Resume-Token handshake header. 0 disables resuming")
+	fs.DurationVar(&o.DetachTimeout, "detach-timeout", o.DetachTimeout, "time a session started with the detach param keeps running without a client, waiting to be reattached. 0 disables detachable sessions")
+	fs.IntVar(&o.Scrollback, "scrollback", o.Scrollback, "bytes of recent output replayed to a client reattaching a detachable session")
+	fs.BoolVar(&o.RecordStdin, "record-stdin", o.RecordStdin, "include client input in recordings, which may capture passwords typed without echo")
+	fs.StringVar(&o.Clusters, "clusters", o.Clusters, "comma separated kubeconfig contexts served under /clusters/{context} or with the cluster param, * for all")
+	fs.BoolVar(&o.ImpersonateAuthenticated, "impersonate-authenticated", o.ImpersonateAuthenticated, "impersonate the user and groups authenticated by -oidc-issuer-url when calling the API server")
+	fs.BoolVar(&o.EnableImpersonation, "enable-impersonation", o.EnableImpersonation, "impersonate the user and groups in X-Remote-User and X-Remote-Group, only for use behind a trusted authenticating proxy")
+	fs.DurationVar(&o.WriteTimeout, "write-timeout", o.WriteTimeout, "time allowed to write a message to the ws peer")
+	fs.Int64Var(&o.MaxMessageSize, "max-message-size", o.MaxMessageSize, "maximum size in bytes of a message from the ws peer")
+	fs.DurationVar(&o.ReadTimeout, "read-timeout", o.ReadTimeout, "time to wait before closing a ws connection due to inactivity")
+	fs.DurationVar(&o.MaxReadTimeout, "max-read-timeout", o.MaxReadTimeout, "longest inactivity timeout a client may ask for with the idleTimeout query param")
+	fs.DurationVar(&o.PingInterval, "ping-interval", o.PingInterval, "time between ws pings, 0 to disable")
+	fs.DurationVar(&o.PongTimeout, "pong-timeout", o.PongTimeout, "time allowed for the ws peer to answer a ping")
+	fs.DurationVar(&o.CloseGrace, "close-grace", o.CloseGrace, "time to wait for the ws peer before force closing the connection")
+}
+
+//ParseFlags parses args into the flags RegisterFlags defined on fs, then sets the ones not given from
+//their K8S_PROXY_ environment variables and after that from the -config file
+func (o *Options) ParseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := applyFlagEnv(fs); err != nil {
+		return err
+	}
+	if len(o.Config) != 0 {
+		return applyConfigFile(fs, o.Config)
+	}
+	return nil
+}
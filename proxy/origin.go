@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"net/url"
+	"strings"
+)
+
+// How long browsers may cache a CORS preflight response, in seconds.
+const corsMaxAge = "600"
+
+//parseAllowedOrigins parses the comma separated -allowed-origins list of origins accepted for ws upgrades
+//and CORS. Empty means same-origin only. Entries are path.Match patterns such as https://*.example.com,
+//or "*" for any origin.
+func parseAllowedOrigins(list string) ([]string, error) {
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		if len(origin) == 0 {
+			continue
+		}
+		if _, err := path.Match(origin, ""); err != nil {
+			return nil, fmt.Errorf("bad -allowed-origins pattern %q", origin)
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+//originAllowed reports whether origin matches the -allowed-origins list
+func (s *Server) originAllowed(origin string) bool {
+	allowed, _ := s.matchOrigin(origin)
+	return allowed
+}
+
+//matchOrigin reports whether origin matches the -allowed-origins list, and whether it matched an entry
+//other than "*" naming it explicitly
+func (s *Server) matchOrigin(origin string) (allowed, explicit bool) {
+	origin = strings.ToLower(origin)
+	for _, pattern := range s.allowedOrigins {
+		if pattern == "*" {
+			allowed = true
+			continue
+		}
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true, true
+		}
+	}
+	return allowed, false
+}
+
+//checkOrigin accepts requests from the allowed origins, or any origin with "*".
+//Without a list it falls back to gorilla's same-origin policy. Requests without
+//an Origin header don't come from a browser and are accepted.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+
+	if len(s.allowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	return s.originAllowed(origin)
+}
+
+//allowCORS lets pages from the allowed origins call the HTTP endpoints, answering preflight
+//requests before authentication since browsers send them without credentials. Only origins matched
+//explicitly may send credentials, "*" lets any page make uncredentialed calls.
+func (s *Server) allowCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed, explicit := s.matchOrigin(origin)
+		if len(origin) == 0 || !allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		if explicit {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			h.Set("Access-Control-Allow-Origin", "*")
+		}
+		h.Add("Vary", "Origin")
+
+		if r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) != 0 {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); len(headers) != 0 {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			h.Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCORSCredentialsOnlyForExplicitOrigins(t *testing.T) {
+	ts := newTestServer(t, func(o *Options) { o.AllowedOrigins = "https://*.good.example,*" })
+
+	for _, test := range []struct {
+		origin      string
+		allowOrigin string
+		credentials string
+	}{
+		{"https://console.good.example", "https://console.good.example", "true"},
+		{"https://evil.example", "*", ""},
+	} {
+		req, _ := http.NewRequest(http.MethodOptions, ts.URL+"/healthz", nil)
+		req.Header.Set("Origin", test.origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != test.allowOrigin {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, want %q", test.origin, got, test.allowOrigin)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Credentials"); got != test.credentials {
+			t.Errorf("%s: got Access-Control-Allow-Credentials %q, want %q", test.origin, got, test.credentials)
+		}
+	}
+}
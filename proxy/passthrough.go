@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+//userConfig returns the config of the request's cluster with its credentials replaced by the client's bearer token when
+//-pass-through-token is set, so RBAC applies to the end user rather than the proxy
+func (s *Server) userConfig(r *http.Request) *rest.Config {
+	base := s.requestCluster(r).config
+	if !s.opts.PassThroughToken {
+		return base
+	}
+	//AnonymousClientConfig copies the config without its credentials, keeping host and CA
+	cfg := rest.AnonymousClientConfig(base)
+	cfg.BearerToken = requestToken(r)
+	return cfg
+}
+
+//requestClient returns a clientset acting as requestConfig(r), reusing the shared one when no per-user config is needed
+func (s *Server) requestClient(r *http.Request) (kubernetes.Interface, error) {
+	c := s.requestCluster(r)
+	cfg := s.requestConfig(r)
+	if cfg == c.config {
+		return c.clientset, nil
+	}
+	return kubernetes.NewForConfig(cfg)
+}
+
+//requireBearer rejects requests without a token to pass through with 401, before any upgrade happens
+func requireBearer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !unauthenticatedPaths[r.URL.Path] && len(requestToken(r)) == 0 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+//policy restricts what exec sessions may target. Empty lists allow everything.
+type policy struct {
+	//Namespaces that can be reached, as path.Match globs
+	Namespaces []string `json:"namespaces"`
+
+	//Pods that can be reached, as path.Match globs
+	Pods []string `json:"pods"`
+
+	//Containers that can be reached, as path.Match globs
+	Containers []string `json:"containers"`
+
+	//Permitted command lines, matched against the space joined command.
+	//An entry ending in * permits any command line starting with the rest of it.
+	Commands []string `json:"commands"`
+
+	//Pods that can never be reached, as path.Match globs of namespace/pod. Deny wins over the allow lists.
+	Deny []string `json:"deny"`
+
+	//Label selectors of pods that can never be reached, e.g. tier=db
+	DenyLabels []string `json:"denyLabels"`
+
+	//Environment variables clients may set with the env param, as path.Match globs of their names.
+	//Empty allows none once commands are restricted, by this policy or -allowed-commands.
+	Env []string `json:"env"`
+
+	//Working directories clients may start sessions in with the cwd param, as path.Match globs.
+	//Empty allows none once commands are restricted, by this policy or -allowed-commands.
+	Workdirs []string `json:"workdirs"`
+}
+
+//policyStore holds the policy read from -policy-file, allowing everything until it is loaded
+type policyStore struct {
+	mu         sync.RWMutex
+	path       string
+	policy     policy
+	denyLabels []labels.Selector
+}
+
+//watch reloads the policy file whenever the process receives SIGHUP, until ctx is done
+func (s *policyStore) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+			if err := s.load(); err != nil {
+				errorf("policy: keeping previous policy, reload failed: %v", err)
+				continue
+			}
+			infof("policy: reloaded %s", s.path)
+		}
+	}()
+}
+
+//load parses the policy file as YAML or JSON. An empty file allows everything.
+func (s *policyStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var p policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return fmt.Errorf("parsing %s: %v", s.path, err)
+	}
+	var patterns []string
+	for _, list := range [][]string{p.Namespaces, p.Pods, p.Containers, p.Deny, p.Env, p.Workdirs} {
+		patterns = append(patterns, list...)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("parsing %s: bad pattern %q", s.path, pattern)
+		}
+	}
+
+	selectors := make([]labels.Selector, 0, len(p.DenyLabels))
+	for _, selector := range p.DenyLabels {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return fmt.Errorf("parsing %s: bad label selector %q: %v", s.path, selector, err)
+		}
+		selectors = append(selectors, parsed)
+	}
+
+	s.mu.Lock()
+	s.policy = p
+	s.denyLabels = selectors
+	s.mu.Unlock()
+	return nil
+}
+
+//check returns an error describing why the exec session is not allowed, or nil
+func (s *policyStore) check(ctx context.Context, client kubernetes.Interface, namespace, podName, containerName string, command []string) error {
+	if err := s.checkTarget(ctx, client, namespace, podName, containerName); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !commandAllowed(s.policy.Commands, command) {
+		return fmt.Errorf("policy: command %q is not allowed", strings.Join(command, " "))
+	}
+	return nil
+}
+
+//checkEnv returns an error when the policy doesn't allow one of the KEY=VALUE env entries or the working directory.
+//Variables such as LD_PRELOAD or BASH_ENV change what a command runs, so once commands are restricted,
+//by the policy or the -allowed-commands list, which allowlist tells, env and cwd need their own allow lists.
+func (s *policyStore) checkEnv(env []string, dir string, allowlist bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	restricted := len(s.policy.Commands) != 0 || allowlist
+	for _, entry := range env {
+		key, _, _ := strings.Cut(entry, "=")
+		if !matchAllowList(s.policy.Env, key, restricted) {
+			return fmt.Errorf("policy: env %s is not allowed", key)
+		}
+	}
+	if len(dir) != 0 && !matchAllowList(s.policy.Workdirs, dir, restricted) {
+		return fmt.Errorf("policy: cwd %s is not allowed", dir)
+	}
+	return nil
+}
+
+//checkTarget returns an error when the policy doesn't allow reaching the container, or nil.
+//Callers resolve the container first, an empty containerName only passes without a containers list.
+func (s *policyStore) checkTarget(ctx context.Context, client kubernetes.Interface, namespace, podName, containerName string) error {
+	if err := s.checkPod(ctx, client, namespace, podName); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !matchAny(s.policy.Containers, containerName) {
+		if len(containerName) == 0 {
+			return fmt.Errorf("policy: a container of pod %s/%s must be named", namespace, podName)
+		}
+		return fmt.Errorf("policy: container %s of pod %s/%s is not allowed", containerName, namespace, podName)
+	}
+	return nil
+}
+
+//checkPod returns an error when the policy doesn't allow reaching the pod, or nil. It is the check of
+//sessions reaching the pod rather than a container, such as port forwards. The pod is fetched with the
+//proxy's own credentials when label selectors are denied.
+func (s *policyStore) checkPod(ctx context.Context, client kubernetes.Interface, namespace, podName string) error {
+	s.mu.RLock()
+	p, denyLabels := s.policy, s.denyLabels
+	s.mu.RUnlock()
+
+	if len(p.Deny) != 0 && matchAny(p.Deny, namespace+"/"+podName) {
+		return fmt.Errorf("policy: pod %s/%s is denied", namespace, podName)
+	}
+	if !matchAny(p.Namespaces, namespace) {
+		return fmt.Errorf("policy: namespace %s is not allowed", namespace)
+	}
+	if !matchAny(p.Pods, podName) {
+		return fmt.Errorf("policy: pod %s/%s is not allowed", namespace, podName)
+	}
+
+	if len(denyLabels) == 0 {
+		return nil
+	}
+	pod, err := client.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("policy: checking labels of pod %s/%s: %v", namespace, podName, err)
+	}
+	for _, selector := range denyLabels {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return fmt.Errorf("policy: pod %s/%s is denied by label selector %s", namespace, podName, selector)
+		}
+	}
+	return nil
+}
+
+//matchAny reports whether name matches one of the globs, or there are none
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//matchAllowList is matchAny for lists that allow nothing when empty and restricted
+func matchAllowList(patterns []string, name string, restricted bool) bool {
+	if len(patterns) == 0 {
+		return !restricted
+	}
+	return matchAny(patterns, name)
+}
+
+func commandAllowed(allowed []string, command []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	line := strings.Join(command, " ")
+	for _, entry := range allowed {
+		if strings.HasSuffix(entry, "*") {
+			if strings.HasPrefix(line, strings.TrimSuffix(entry, "*")) {
+				return true
+			}
+		} else if line == entry {
+			return true
+		}
+	}
+	return false
+}
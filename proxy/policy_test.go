@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"k8s.io/client-go/rest"
+)
+
+//writePolicy writes a policy file for -policy-file, returning its path
+func writePolicy(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+//expectClose reads from ws until it closes, failing unless it closes with code
+func expectClose(t *testing.T, ws *websocket.Conn, code int) {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			t.Fatalf("got %v, want close code %d", err, code)
+		}
+		return
+	}
+}
+
+func TestEnvAndCwdOnceCommandsAreRestricted(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		allowed  string
+		policy   string
+		query    string
+		accepted bool
+	}{
+		{"unrestricted env", "", "", "&env=FOO=1", true},
+		{"env with -allowed-commands", "cat", "", "&env=LD_PRELOAD=/tmp/x.so", false},
+		{"env with policy commands", "", `commands: ["cat"]`, "&env=BASH_ENV=/tmp/x", false},
+		{"env in the policy's env", "", "commands: [\"cat\"]\nenv: [\"TERM\"]", "&env=TERM=xterm", true},
+		{"env not in the policy's env", "", "commands: [\"cat\"]\nenv: [\"TERM\"]", "&env=ENV=/tmp/x", false},
+		{"cwd with policy commands", "", `commands: ["cat"]`, "&cwd=/app", false},
+		{"cwd without its shell allowed", "cat", `workdirs: ["/app"]`, "&cwd=/app", false},
+		{"cwd in the policy's workdirs", "cat,/bin/sh", `workdirs: ["/app"]`, "&cwd=/app", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServer(t, func(o *Options) {
+				o.AllowedCommands = test.allowed
+				if len(test.policy) != 0 {
+					o.PolicyFile = writePolicy(t, test.policy)
+				}
+			})
+			ws, _, err := dialExec(ts, test.query, nil)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer ws.Close()
+			if test.accepted {
+				echo(t, ws, "hello\n")
+			} else {
+				expectClose(t, ws, websocket.ClosePolicyViolation)
+			}
+		})
+	}
+}
+
+func TestAuthzWebhookSeesEnvAndCwd(t *testing.T) {
+	inputs := make(chan authzInput, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input authzInput `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		inputs <- body.Input
+		w.Write([]byte(`{"result": {"allow": false, "reason": "no"}}`))
+	}))
+	defer webhook.Close()
+	ts := newTestServer(t, func(o *Options) { o.AuthzWebhookURL = webhook.URL })
+
+	ws, _, err := dialExec(ts, "&env=TERM=xterm&env=API_KEY=s3cret&cwd=/app", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	expectClose(t, ws, websocket.ClosePolicyViolation)
+
+	var input authzInput
+	select {
+	case input = <-inputs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook wasn't asked")
+	}
+	if !reflect.DeepEqual(input.Env, []string{"TERM", "API_KEY"}) || input.Cwd != "/app" {
+		t.Errorf("webhook got env %q and cwd %q, want the variable names and /app", input.Env, input.Cwd)
+	}
+	if !reflect.DeepEqual(input.Command, []string{"cat"}) {
+		t.Errorf("webhook got command %q, want the unwrapped command", input.Command)
+	}
+}
+
+//TestPolicyChecksDefaultContainer reaches a container the policy denies by leaving out the container param
+func TestPolicyChecksDefaultContainer(t *testing.T) {
+	for _, test := range []struct {
+		container string
+		allowed   bool
+	}{
+		{"app", true},
+		{"db", false},
+	} {
+		t.Run(test.container, func(t *testing.T) {
+			api := newPodAPI(t, testPod(test.container))
+			ts := newTestServer(t, func(o *Options) {
+				o.RESTConfig = &rest.Config{Host: api}
+				o.PolicyFile = writePolicy(t, `containers: ["app"]`)
+			})
+			pod := ts.URL + "/api/v1/namespaces/default/pods/web-0"
+
+			status, _ := download(t, pod+"/which?cmd=bash", nil)
+			if want := map[bool]int{true: http.StatusOK, false: http.StatusForbidden}[test.allowed]; status != want {
+				t.Errorf("which: got status %d, want %d", status, want)
+			}
+
+			dialer := websocket.Dialer{Subprotocols: []string{"v5.channel.k8s.io"}, HandshakeTimeout: 5 * time.Second}
+			ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(pod, "http")+"/exec?command=cat&tty=false", nil)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer ws.Close()
+			if test.allowed {
+				echo(t, ws, "hello\n")
+			} else {
+				expectClose(t, ws, websocket.ClosePolicyViolation)
+			}
+		})
+	}
+}
+
+func TestPolicyNeedsContainerNamed(t *testing.T) {
+	s := &policyStore{policy: policy{Containers: []string{"app"}}}
+	if err := s.checkTarget(context.Background(), nil, "default", "web-0", ""); err == nil {
+		t.Error("checkTarget let an empty container name past the containers list")
+	}
+	if err := s.checkPod(context.Background(), nil, "default", "web-0"); err != nil {
+		t.Errorf("checkPod: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+//servePortForward bridges a ws connection to a TCP port in the pod. Bytes from the pod are sent
+//as "1"-prefixed base64 frames and client frames are decoded and written to the pod.
+func (s *Server) servePortForward(w http.ResponseWriter, r *http.Request) {
+	guard := &responseGuard{ResponseWriter: w}
+	release, ok := s.admitSession(guard, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	params := mux.Vars(r)
+	vals := r.URL.Query()
+	namespace := params["namespace"]
+	podName := params["podName"]
+	if err := validateTarget(namespace, podName); err != nil {
+		httpError(guard, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	port, err := strconv.ParseUint(vals.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		httpError(guard, http.StatusBadRequest, fmt.Sprintf("invalid port %q", vals.Get("port")))
+		return
+	}
+	enc, err := s.requestEncoding(r)
+	if err != nil {
+		httpError(guard, http.StatusBadRequest, err.Error())
+		return
+	}
+	idleTimeout, err := s.requestIdleTimeout(vals)
+	if err != nil {
+		httpError(guard, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logger := s.newSessionLogger(r, "portforward", namespace, podName, "")
+
+	ws, err := s.upgradeWs(guard, r, logger, nil)
+	if err != nil {
+		logger.errorf("upgrade: %v", err)
+		upgradeFailures.Inc()
+		return
+	}
+	defer ws.Close()
+	defer sessionStarted("portforward", namespace)()
+
+	if !s.sessions.add(ws, logger) {
+		logger.ended("rejected: server draining")
+		s.errToWs(ws, websocket.CloseTryAgainLater, "server draining")
+		return
+	}
+	defer s.sessions.remove(ws)
+	defer s.limitDuration(logger, nil)()
+
+	err = s.policy.checkPod(r.Context(), s.requestCluster(r).clientset, namespace, podName)
+	if err == nil {
+		err = s.authorize(r, "portforward", namespace, podName, "", nil)
+	}
+	if err != nil {
+		logger.ended(fmt.Sprintf("rejected: %v", err))
+		s.errToWs(ws, websocket.ClosePolicyViolation, err.Error())
+		return
+	}
+
+	streamConn, err := dialPortForward(s.requestConfig(r), s.requestCluster(r).clientset, namespace, podName)
+	if err != nil {
+		logger.errorf("dial: %v", err)
+		s.errToWs(ws, websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+	//Closing the ws closes the forwarded connection with it
+	defer streamConn.Close()
+
+	errorStream, dataStream, err := createPortForwardStreams(streamConn, port)
+	if err != nil {
+		logger.errorf("streams: %v", err)
+		s.errToWs(ws, websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+
+	//The pod reports failures such as nothing listening on the port on the error stream
+	errCh := make(chan error, 1)
+	go func() {
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			errCh <- fmt.Errorf("reading error stream for port %d: %v", port, err)
+		case len(message) > 0:
+			errCh <- fmt.Errorf("forwarding port %d: %s", port, message)
+		}
+		close(errCh)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	k := s.startKeepalive(ctx, ws, idleTimeout)
+
+	writer := newChanWriter()
+	writerDone := make(chan struct{})
+	go func() {
+		s.handleWriter(writer, ws, k, enc, logger)
+		close(writerDone)
+	}()
+
+	remoteDone := make(chan struct{})
+	go func() {
+		io.Copy(writer, dataStream)
+		close(remoteDone)
+	}()
+
+	localDone := make(chan struct{})
+	go func() {
+		s.forwardToPod(ws, k, dataStream, enc, logger)
+		close(localDone)
+	}()
+
+	logger.infof("port forward started port=%d", port)
+
+	select {
+	case <-localDone:
+		logger.ended("client disconnected")
+		writer.Close()
+		return
+	case err = <-errCh:
+	case <-remoteDone:
+		err = <-errCh
+	}
+
+	if err != nil {
+		logger.errorf("%v", err)
+		logger.ended("forward failed")
+		writer.closeWithError(err)
+	} else {
+		logger.ended("remote closed")
+		writer.Close()
+	}
+	<-writerDone
+}
+
+//dialPortForward opens a SPDY connection to the pod's portforward subresource as cfg's user
+func dialPortForward(cfg *rest.Config, client kubernetes.Interface, namespace, podName string) (httpstream.Connection, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	req := client.CoreV1().RESTClient().Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(podName).
+		SubResource("portforward")
+
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+	streamConn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	return streamConn, err
+}
+
+//createPortForwardStreams opens the error and data streams for one forwarded connection to port
+func createPortForwardStreams(streamConn httpstream.Connection, port uint64) (httpstream.Stream, httpstream.Stream, error) {
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.FormatUint(port, 10))
+	headers.Set(corev1.PortForwardRequestIDHeader, "0")
+	errorStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	// we're not writing to this stream
+	errorStream.Close()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	return errorStream, dataStream, nil
+}
+
+//forwardToPod decodes ws frames and writes them to the pod until the client goes away
+func (s *Server) forwardToPod(ws *websocket.Conn, k *keepalive, dataStream httpstream.Stream, enc *frameEncoding, logger *sessionLogger) {
+	// inform the pod we're not sending any more data
+	defer dataStream.Close()
+	ws.SetReadLimit(s.opts.MaxMessageSize)
+
+	for {
+		k.activity()
+		_, message, err := s.readMessage(ws)
+		if err != nil {
+			return
+		}
+		if len(message) == 0 {
+			continue
+		}
+
+		_, data, err := enc.parse(message)
+		if err != nil {
+			return
+		}
+		n, err := dataStream.Write(data)
+		logger.countIn(n)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Prefix template used when merging several streams into one view.
+const defaultLinePrefix = "[{pod}/{container}] "
+
+//expandPrefix fills the {namespace}, {pod} and {container} placeholders of a line prefix template
+func expandPrefix(template, namespace, podName, containerName string) string {
+	return strings.NewReplacer(
+		"{namespace}", namespace,
+		"{pod}", podName,
+		"{container}", containerName,
+	).Replace(template)
+}
+
+//prefixWriter prepends a prefix to every line written through it.
+//Partial lines are tracked across writes so the prefix only lands at real line starts.
+type prefixWriter struct {
+	mu          sync.Mutex
+	w           io.Writer
+	prefix      []byte
+	atLineStart bool
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix), atLineStart: true}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if p.atLineStart {
+			buf.Write(p.prefix)
+		}
+		buf.Write(line)
+		p.atLineStart = line[len(line)-1] == '\n'
+	}
+
+	if _, err := p.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+//newStdinLimiter returns a token bucket allowing bytesPerSec of stdin with a one second burst,
+//or nil when bytesPerSec is not positive and stdin is unlimited
+func newStdinLimiter(bytesPerSec int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)
+}
+
+//receiveLimited forwards data to the pipe in burst sized chunks, waiting for the limiter before each.
+//Blocking here stops the reader from pulling further frames, pushing back on the client through the socket.
+func (s *Server) receiveLimited(ctx context.Context, dp stdinPipe, data []byte, limiter *rate.Limiter) (int, error) {
+	if limiter == nil {
+		return s.receiveStdin(dp, data)
+	}
+
+	written := 0
+	for len(data) > 0 {
+		chunk := len(data)
+		if chunk > limiter.Burst() {
+			chunk = limiter.Burst()
+		}
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			return written, err
+		}
+
+		n, err := s.receiveStdin(dp, data[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		data = data[chunk:]
+	}
+	return written, nil
+}
+
+// Time after which the bucket of a client that opened no session is forgotten.
+const upgradeLimiterIdle = 10 * time.Minute
+
+//keyedLimiter holds a token bucket per remote address and per user, limiting how fast they open sessions
+type keyedLimiter struct {
+	mu        sync.Mutex
+	rate      rate.Limit
+	burst     int
+	limiters  map[string]*rate.Limiter
+	lastSeen  map[string]time.Time
+	lastSweep time.Time
+}
+
+//newKeyedLimiter returns buckets refilled at perSec tokens per second holding up to burst
+func newKeyedLimiter(perSec float64, burst int) *keyedLimiter {
+	return &keyedLimiter{
+		rate:     rate.Limit(perSec),
+		burst:    burst,
+		limiters: make(map[string]*rate.Limiter),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+//allow takes a token from the buckets of ip and user, returning why not when either is empty.
+//It always succeeds without -upgrade-rate.
+func (l *keyedLimiter) allow(ip, user string) error {
+	if l.rate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.forget(now)
+	if !l.take("ip:"+ip, now) {
+		return fmt.Errorf("too many new sessions from %s", ip)
+	}
+	if len(user) != 0 && !l.take("user:"+user, now) {
+		return fmt.Errorf("too many new sessions for user %s", user)
+	}
+	return nil
+}
+
+func (l *keyedLimiter) take(key string, now time.Time) bool {
+	limiter, ok := l.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(l.rate, l.burst)
+		l.limiters[key] = limiter
+	}
+	l.lastSeen[key] = now
+	return limiter.AllowN(now, 1)
+}
+
+//forget drops the buckets of clients idle for long enough that theirs would be full again
+func (l *keyedLimiter) forget(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, seen := range l.lastSeen {
+		if now.Sub(seen) > upgradeLimiterIdle {
+			delete(l.limiters, key)
+			delete(l.lastSeen, key)
+		}
+	}
+}
+
+//requestUser identifies who opens a session for the per-user limits: the impersonated or authenticated
+//user, or else a digest of the bearer token. It is empty for anonymous requests.
+func (s *Server) requestUser(r *http.Request) string {
+	if user := s.requestConfig(r).Impersonate.UserName; len(user) != 0 {
+		return user
+	}
+	if id := requestIdentity(r); id != nil {
+		return id.user
+	}
+	if token := requestToken(r); len(token) != 0 {
+		sum := sha256.Sum256([]byte(token))
+		return "token-" + hex.EncodeToString(sum[:4])
+	}
+	return ""
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+//parseRecordNamespaces parses the comma separated -record-namespaces list of globs naming the namespaces
+//whose sessions are recorded. Empty records every namespace.
+func parseRecordNamespaces(list string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) == 0 {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad -record-namespaces pattern %q", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+//asciicastHeader is the first line of an asciicast v2 file
+type asciicastHeader struct {
+	Version   int    `json:"version"`
+	Width     uint16 `json:"width"`
+	Height    uint16 `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title"`
+}
+
+//recorder writes the terminal I/O of a session as an asciicast v2 file
+type recorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	start   time.Time
+	pending map[string][]byte
+	logger  *sessionLogger
+	stdin   bool
+	failed  bool
+}
+
+//startRecording creates the recording of a session under -record-dir, returning nil when
+//recording is disabled or the namespace isn't selected by -record-namespaces
+func (s *Server) startRecording(logger *sessionLogger, namespace, podName, containerName string, size remotecommand.TerminalSize) (*recorder, error) {
+	if len(s.opts.RecordDir) == 0 || !matchAny(s.recordNamespaces, namespace) {
+		return nil, nil
+	}
+
+	name := filepath.Join(s.opts.RecordDir, fmt.Sprintf("%s_%s_%s.cast", namespace, podName, logger.id))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("creating recording: %v", err)
+	}
+
+	rec := &recorder{f: f, start: time.Now(), pending: make(map[string][]byte), logger: logger, stdin: s.opts.RecordStdin}
+	header, err := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     size.Width,
+		Height:    size.Height,
+		Timestamp: rec.start.Unix(),
+		Title:     fmt.Sprintf("%s/%s/%s", namespace, podName, containerName),
+	})
+	if err == nil {
+		_, err = f.Write(append(header, '\n'))
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing recording: %v", err)
+	}
+	logger.record.Recording = name
+	return rec, nil
+}
+
+//event appends an event of type code ("o" output, "i" input, "r" resize) with the time since the start
+func (r *recorder) event(code string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed {
+		return
+	}
+
+	//Hold back a rune split across writes so the event stays valid UTF-8
+	data = append(r.pending[code], data...)
+	data, r.pending[code] = splitUTF8(data)
+	if len(data) == 0 {
+		return
+	}
+
+	line, err := json.Marshal([]interface{}{time.Since(r.start).Seconds(), code, string(data)})
+	if err == nil {
+		_, err = r.f.Write(append(line, '\n'))
+	}
+	if err != nil {
+		r.logger.errorf("recording: %v", err)
+		r.failed = true
+	}
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+//splitUTF8 splits b before a trailing incomplete rune
+func splitUTF8(b []byte) ([]byte, []byte) {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i], append([]byte(nil), b[i:]...)
+			}
+			break
+		}
+	}
+	return b, nil
+}
+
+//output returns a writer recording what is written to w as output
+func (r *recorder) output(w io.Writer) io.Writer {
+	return recordingWriter{r, w}
+}
+
+type recordingWriter struct {
+	r *recorder
+	w io.Writer
+}
+
+func (rw recordingWriter) Write(p []byte) (int, error) {
+	rw.r.event("o", p)
+	return rw.w.Write(p)
+}
+
+//input returns a reader recording what is read from src as input, when -record-stdin is set
+func (r *recorder) input(src io.Reader) io.Reader {
+	if !r.stdin {
+		return src
+	}
+	return recordingReader{r, src}
+}
+
+type recordingReader struct {
+	r   *recorder
+	src io.Reader
+}
+
+func (rr recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.src.Read(p)
+	if n > 0 {
+		rr.r.event("i", p[:n])
+	}
+	return n, err
+}
+
+//sizes returns a size queue recording the sizes passed on from q as resize events
+func (r *recorder) sizes(q remotecommand.TerminalSizeQueue) remotecommand.TerminalSizeQueue {
+	return recordingSizeQueue{r, q}
+}
+
+type recordingSizeQueue struct {
+	r *recorder
+	q remotecommand.TerminalSizeQueue
+}
+
+func (rq recordingSizeQueue) Next() *remotecommand.TerminalSize {
+	size := rq.q.Next()
+	if size != nil {
+		rq.r.event("r", []byte(fmt.Sprintf("%dx%d", size.Width, size.Height)))
+	}
+	return size
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"encoding/json"
+	"sync"
+
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Terminal size used when the client doesn't supply one.
+const (
+	defaultCols = 80
+	defaultRows = 24
+)
+
+//resizeMessage is the payload of a resize frame, e.g. {"cols":120,"rows":40}.
+//Clients of the Kubernetes subprotocols send {"Width":120,"Height":40} instead.
+type resizeMessage struct {
+	Cols   uint16 `json:"cols"`
+	Rows   uint16 `json:"rows"`
+	Width  uint16 `json:"width"`
+	Height uint16 `json:"height"`
+}
+
+//sizeQueue is a remotecommand.TerminalSizeQueue fed by resize frames from the ws client
+type sizeQueue struct {
+	ch   chan remotecommand.TerminalSize
+	done chan struct{}
+	once sync.Once
+}
+
+func newSizeQueue() *sizeQueue {
+	return &sizeQueue{
+		ch:   make(chan remotecommand.TerminalSize, 4),
+		done: make(chan struct{}),
+	}
+}
+
+//Next blocks until a new size is available, returning nil once the session is closed
+func (q *sizeQueue) Next() *remotecommand.TerminalSize {
+	select {
+	case size := <-q.ch:
+		return &size
+	case <-q.done:
+		return nil
+	}
+}
+
+//push queues a size without blocking the reader, dropping the oldest pending size when full
+func (q *sizeQueue) push(size remotecommand.TerminalSize) {
+	for {
+		select {
+		case q.ch <- size:
+			return
+		default:
+		}
+
+		select {
+		case <-q.ch:
+		default:
+		}
+	}
+}
+
+//close releases any pending Next call
+func (q *sizeQueue) close() {
+	q.once.Do(func() { close(q.done) })
+}
+
+//parseResize decodes the JSON payload of a resize frame
+func parseResize(data []byte) (remotecommand.TerminalSize, error) {
+	var msg resizeMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return remotecommand.TerminalSize{}, err
+	}
+	if msg.Cols == 0 && msg.Rows == 0 {
+		return remotecommand.TerminalSize{Width: msg.Width, Height: msg.Height}, nil
+	}
+	return remotecommand.TerminalSize{Width: msg.Cols, Height: msg.Rows}, nil
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+//errStdinStalled reports stdin the container didn't read within -stdin-stall-timeout
+var errStdinStalled = errors.New("container is not reading stdin")
+
+//ringPipe is a stdinPipe backed by a bounded ring buffer. Unlike io.Pipe, receiveData
+//returns as soon as the data fits in the buffer, so the ws reader keeps processing frames
+//while the executor is busy, and only blocks once the buffer is full.
+type ringPipe struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	start  int
+	size   int
+	closed bool
+}
+
+func newRingPipe(capacity int) *ringPipe {
+	p := &ringPipe{buf: make([]byte, capacity)}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *ringPipe) receiveData(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.receive(data, nil)
+}
+
+//receiveDataWithin is receiveData giving up with errStdinStalled once the buffer stayed full for timeout,
+//returning how much of data was buffered until then
+func (p *ringPipe) receiveDataWithin(data []byte, timeout time.Duration) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stalled := false
+	timer := time.AfterFunc(timeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		stalled = true
+		p.cond.Broadcast()
+	})
+	defer timer.Stop()
+	return p.receive(data, &stalled)
+}
+
+//receive copies data into the buffer as room frees up, until stalled is set. Callers hold p.mu.
+func (p *ringPipe) receive(data []byte, stalled *bool) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		for p.size == len(p.buf) && !p.closed && (stalled == nil || !*stalled) {
+			p.cond.Wait()
+		}
+		if p.closed {
+			return written, io.ErrClosedPipe
+		}
+		if p.size == len(p.buf) {
+			return written, errStdinStalled
+		}
+
+		end := (p.start + p.size) % len(p.buf)
+		free := len(p.buf) - p.size
+		if free > len(p.buf)-end {
+			free = len(p.buf) - end
+		}
+
+		n := copy(p.buf[end:end+free], data)
+		p.size += n
+		written += n
+		data = data[n:]
+		p.cond.Broadcast()
+	}
+	return written, nil
+}
+
+func (p *ringPipe) Read(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.size == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if p.size == 0 {
+		return 0, io.EOF
+	}
+
+	available := p.size
+	if available > len(p.buf)-p.start {
+		available = len(p.buf) - p.start
+	}
+
+	n := copy(data, p.buf[p.start:p.start+available])
+	p.start = (p.start + n) % len(p.buf)
+	p.size -= n
+	p.cond.Broadcast()
+	return n, nil
+}
+
+//Close stops further writes, letting the reader drain what is buffered before EOF
+func (p *ringPipe) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+//Long enough for a call that doesn't block to have returned
+const blockedWait = 100 * time.Millisecond
+
+//receiveAsync calls p.receiveData(data) in the background, the returned channel delivering its error
+func receiveAsync(p stdinPipe, data []byte) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.receiveData(data)
+		done <- err
+	}()
+	return done
+}
+
+func TestRingPipeAcceptsUpToCapacity(t *testing.T) {
+	p := newRingPipe(8)
+	//Nothing reads, the frames are only buffered
+	for _, frame := range []string{"abc", "defgh"} {
+		select {
+		case err := <-receiveAsync(p, []byte(frame)):
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("receiving %q blocked with room in the buffer", frame)
+		}
+	}
+
+	buf := make([]byte, 16)
+	n, err := io.ReadFull(p, buf[:8])
+	if err != nil || string(buf[:n]) != "abcdefgh" {
+		t.Fatalf("read %q, %v, want %q", buf[:n], err, "abcdefgh")
+	}
+}
+
+func TestRingPipeBlocksWhenFull(t *testing.T) {
+	p := newRingPipe(4)
+	if _, err := p.receiveData([]byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	done := receiveAsync(p, []byte("ef"))
+	select {
+	case err := <-done:
+		t.Fatalf("receiving into a full buffer returned %v, want it to block", err)
+	case <-time.After(blockedWait):
+	}
+
+	//Reading frees room for the blocked frame, which wraps around the end of the buffer
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(p, buf); err != nil || string(buf) != "ab" {
+		t.Fatalf("read %q, %v, want %q", buf, err, "ab")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receiving stayed blocked once the buffer had room")
+	}
+	buf = make([]byte, 4)
+	if _, err := io.ReadFull(p, buf); err != nil || string(buf) != "cdef" {
+		t.Fatalf("read %q, %v, want %q", buf, err, "cdef")
+	}
+}
+
+func TestRingPipeClose(t *testing.T) {
+	p := newRingPipe(4)
+	if _, err := p.receiveData([]byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	done := receiveAsync(p, []byte("e"))
+	p.Close()
+	if err := <-done; !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("receiving blocked on a closed pipe: got %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	//What was buffered is still read, then EOF
+	data, err := io.ReadAll(p)
+	if err != nil || string(data) != "abcd" {
+		t.Fatalf("read %q, %v, want %q", data, err, "abcd")
+	}
+}
+
+func TestRingPipeStalled(t *testing.T) {
+	p := newRingPipe(4)
+	n, err := p.receiveDataWithin([]byte("abcdef"), 20*time.Millisecond)
+	if n != 4 || !errors.Is(err, errStdinStalled) {
+		t.Fatalf("got %d, %v, want 4 bytes buffered and %v", n, err, errStdinStalled)
+	}
+}
+
+func TestDataPipeBlocksUntilRead(t *testing.T) {
+	//Unlike the ring, io.Pipe holds every frame until the executor reads it
+	p := newDataPipe()
+	done := receiveAsync(p, []byte("a"))
+	select {
+	case err := <-done:
+		t.Fatalf("receiving without a reader returned %v, want it to block", err)
+	case <-time.After(blockedWait):
+	}
+
+	buf := make([]byte, 1)
+	if _, err := p.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+//stalledExecutor stands for a container that doesn't read stdin until resume is closed, reporting the
+//terminal sizes it is sent
+type stalledExecutor struct {
+	sizes  chan remotecommand.TerminalSize
+	resume chan struct{}
+}
+
+func (e stalledExecutor) Stream(options remotecommand.StreamOptions) error {
+	return e.StreamWithContext(context.Background(), options)
+}
+
+func (e stalledExecutor) StreamWithContext(ctx context.Context, options remotecommand.StreamOptions) error {
+	go func() {
+		for size := options.TerminalSizeQueue.Next(); size != nil; size = options.TerminalSizeQueue.Next() {
+			e.sizes <- *size
+		}
+	}()
+	select {
+	case <-e.resume:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	//Stdin ends once the client is gone
+	io.Copy(io.Discard, options.Stdin)
+	return ctx.Err()
+}
+
+//TestStdinStalledExecutor sends a resize after more stdin than the executor takes. With -stdin-buffer
+//the reader gets to the resize right away, io.Pipe holds it up until the executor reads stdin.
+func TestStdinStalledExecutor(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		buffer  int
+		resized bool
+	}{
+		{"ring", 1024, true},
+		{"pipe", 0, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			executor := stalledExecutor{sizes: make(chan remotecommand.TerminalSize, 16), resume: make(chan struct{})}
+			executorBackends["stalled"] = func(*rest.Config, string, *url.URL) (remotecommand.Executor, error) {
+				return executor, nil
+			}
+			t.Cleanup(func() { delete(executorBackends, "stalled") })
+			ts := newTestServer(t, func(o *Options) {
+				o.ExecBackend = "stalled"
+				o.StdinBuffer = test.buffer
+			})
+
+			ws, _, err := dialExec(ts, "", nil)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer ws.Close()
+			stdin := append([]byte{0}, bytes.Repeat([]byte("x"), 512)...)
+			if err := ws.WriteMessage(websocket.BinaryMessage, stdin); err != nil {
+				t.Fatal(err)
+			}
+			resize := append([]byte{4}, `{"Width":100,"Height":40}`...)
+			if err := ws.WriteMessage(websocket.BinaryMessage, resize); err != nil {
+				t.Fatal(err)
+			}
+
+			//resized waits for the resize, skipping the initial size
+			resized := func(wait time.Duration) bool {
+				timeout := time.After(wait)
+				for {
+					select {
+					case size := <-executor.sizes:
+						if size.Width == 100 && size.Height == 40 {
+							return true
+						}
+					case <-timeout:
+						return false
+					}
+				}
+			}
+			if test.resized {
+				if !resized(time.Second) {
+					t.Fatal("resize wasn't processed while the executor stalled")
+				}
+				close(executor.resume)
+				return
+			}
+			if resized(blockedWait) {
+				t.Fatal("resize was processed before the stdin frame ahead of it was read")
+			}
+			close(executor.resume)
+			if !resized(time.Second) {
+				t.Fatal("resize wasn't processed once the executor read stdin")
+			}
+		})
+	}
+}
+
+func TestStdinBufferSessionEcho(t *testing.T) {
+	ts := newTestServer(t, func(o *Options) { o.StdinBuffer = 16 })
+	ws, _, err := dialExec(ts, "", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	//Frames larger than the buffer go through in pieces
+	echo(t, ws, strings.Repeat("0123456789", 10))
+}
@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+//Server is the exec proxy. Its options, clusters, policy and sessions are its own, so Servers with different
+//options can run side by side. Logging, metrics and tracing are process wide.
+type Server struct {
+	opts         Options
+	handler      http.Handler
+	tlsConfig    *tls.Config
+	authenticate func(http.Handler) http.Handler
+
+	//Done once the Server is closed, stopping the goroutines reloading its files and posting its audit records
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	upgrader websocket.Upgrader
+
+	//Origins accepted for ws upgrades and CORS, set from -allowed-origins. Empty means same-origin only.
+	allowedOrigins []string
+
+	//Binaries sessions may run, set from -allowed-commands. Empty allows any binary.
+	allowedCommands map[string]bool
+
+	//Shells probed in order for sessions without a command, set from -shells. Empty runs /bin/sh -i.
+	shellChain []string
+
+	//Images the debug endpoint may start, as path.Match globs set from -debug-images
+	debugImageGlobs []string
+
+	//Profiles clients may pick, set from -debug-profiles
+	allowedDebugProfiles map[string]bool
+
+	//Namespaces whose sessions are recorded, set from -record-namespaces. Empty records every namespace.
+	recordNamespaces []string
+
+	//Networks of reverse proxies whose X-Forwarded-* headers are believed, set from -trusted-proxies
+	trustedProxies []*net.IPNet
+
+	//Creates the executors of every exec, attach, cp, which and shell probe stream, set from -exec-backend
+	newExecutor executorFactory
+
+	clusters    *clusterSet
+	policy      *policyStore
+	adminTokens *tokenStore
+	audit       *auditLog
+
+	sessions      *sessionRegistry
+	detachable    *detachRegistry
+	observed      *observerRegistry
+	upgradeLimits *keyedLimiter
+	readiness     readinessCache
+
+	//Shared across sessions so reconnect storms can't spam the API server with events
+	eventLimiter *rate.Limiter
+}
+
+//New validates opts, loads the clusters, policy and credentials they name and builds the Server's routes.
+//The Server reloads them until Close is called.
+func New(opts Options) (_ *Server, err error) {
+	s := &Server{
+		opts:         opts,
+		policy:       &policyStore{},
+		clusters:     &clusterSet{},
+		detachable:   &detachRegistry{sessions: make(map[string]*detachableSession)},
+		observed:     newObserverRegistry(),
+		eventLimiter: rate.NewLimiter(rate.Every(time.Second), 10),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	//Reloaders started before a later step failed are stopped along with the Server
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	if err := setLogLevel(s.opts.LogLevel); err != nil {
+		return nil, err
+	}
+	if err := setLogFormat(s.opts.LogFormat); err != nil {
+		return nil, err
+	}
+	if _, err := lookupEncoding(s.opts.Base64); err != nil {
+		return nil, err
+	}
+	if len(s.opts.BasePath) != 0 {
+		if !strings.HasPrefix(s.opts.BasePath, "/") {
+			return nil, fmt.Errorf("invalid -base-path %q, must start with /", s.opts.BasePath)
+		}
+		s.opts.BasePath = strings.TrimRight(s.opts.BasePath, "/")
+	}
+	if s.trustedProxies, err = parseTrustedProxies(s.opts.TrustedProxies); err != nil {
+		return nil, err
+	}
+	for name, d := range map[string]time.Duration{"-write-timeout": s.opts.WriteTimeout, "-read-timeout": s.opts.ReadTimeout, "-close-grace": s.opts.CloseGrace, "-pong-timeout": s.opts.PongTimeout, "-max-read-timeout": s.opts.MaxReadTimeout} {
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid %s %v, must be positive", name, d)
+		}
+	}
+	//Room for the channel prefix and at least one base64 quantum
+	if s.opts.MaxMessageSize < 5 {
+		return nil, fmt.Errorf("invalid -max-message-size %d, must be at least 5", s.opts.MaxMessageSize)
+	}
+	if s.opts.PingInterval < 0 {
+		return nil, fmt.Errorf("invalid -ping-interval %v, must not be negative", s.opts.PingInterval)
+	}
+	if s.opts.OutputFlushInterval < 0 {
+		return nil, fmt.Errorf("invalid -output-flush-interval %v, must not be negative", s.opts.OutputFlushInterval)
+	}
+	if s.opts.UpgradeRate < 0 {
+		return nil, fmt.Errorf("invalid -upgrade-rate %v, must not be negative", s.opts.UpgradeRate)
+	}
+	if s.opts.UpgradeRate > 0 && s.opts.UpgradeBurst < 1 {
+		return nil, fmt.Errorf("invalid -upgrade-burst %d, must be at least 1", s.opts.UpgradeBurst)
+	}
+	if s.opts.StdinBuffer < 0 {
+		return nil, fmt.Errorf("invalid -stdin-buffer %d, must not be negative", s.opts.StdinBuffer)
+	}
+	if s.opts.MaxSessionDuration < 0 || s.opts.SessionEndWarning < 0 {
+		return nil, fmt.Errorf("invalid -max-session-duration %v or -session-end-warning %v, must not be negative", s.opts.MaxSessionDuration, s.opts.SessionEndWarning)
+	}
+	if s.opts.StdinStallTimeout < 0 {
+		return nil, fmt.Errorf("invalid -stdin-stall-timeout %v, must not be negative", s.opts.StdinStallTimeout)
+	}
+	if s.opts.StdinStallTimeout > 0 && s.opts.StdinBuffer == 0 {
+		return nil, errors.New("-stdin-stall-timeout needs a -stdin-buffer to hold stdin while it waits")
+	}
+	if s.opts.ResumeWindow < 0 {
+		return nil, fmt.Errorf("invalid -resume-window %v, must not be negative", s.opts.ResumeWindow)
+	}
+	if s.opts.DetachTimeout < 0 {
+		return nil, fmt.Errorf("invalid -detach-timeout %v, must not be negative", s.opts.DetachTimeout)
+	}
+	if s.opts.Scrollback < 0 {
+		return nil, fmt.Errorf("invalid -scrollback %d, must not be negative", s.opts.Scrollback)
+	}
+	if s.opts.TraceSampleRatio < 0 || s.opts.TraceSampleRatio > 1 {
+		return nil, fmt.Errorf("invalid -trace-sample-ratio %v, must be between 0 and 1", s.opts.TraceSampleRatio)
+	}
+	if s.opts.CompressionLevel < flate.BestSpeed || s.opts.CompressionLevel > flate.BestCompression {
+		return nil, fmt.Errorf("invalid -compression-level %d, must be between %d and %d", s.opts.CompressionLevel, flate.BestSpeed, flate.BestCompression)
+	}
+	if s.allowedOrigins, err = parseAllowedOrigins(s.opts.AllowedOrigins); err != nil {
+		return nil, err
+	}
+	s.allowedCommands = parseAllowedCommands(s.opts.AllowedCommands)
+	s.shellChain = parseShells(s.opts.Shells)
+	if s.debugImageGlobs, s.allowedDebugProfiles, err = parseDebugFlags(s.opts.DebugImages, s.opts.DebugProfiles); err != nil {
+		return nil, err
+	}
+	if s.recordNamespaces, err = parseRecordNamespaces(s.opts.RecordNamespaces); err != nil {
+		return nil, err
+	}
+	s.upgrader = websocket.Upgrader{
+		EnableCompression: s.opts.Compression,
+		CheckOrigin:       s.checkOrigin,
+		Subprotocols:      k8sSubprotocols,
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			httpError(w, status, reason.Error())
+		},
+	}
+
+	if s.newExecutor, err = executorBackend(s.opts.ExecBackend); err != nil {
+		return nil, err
+	}
+	s.opts.ExecMethod = strings.ToUpper(s.opts.ExecMethod)
+	if s.opts.ExecMethod != http.MethodPost && s.opts.ExecMethod != http.MethodGet {
+		return nil, fmt.Errorf("invalid -exec-method %q, must be POST or GET", s.opts.ExecMethod)
+	}
+
+	if s.opts.KubeconfigReloadInterval < 0 {
+		return nil, fmt.Errorf("invalid -kubeconfig-reload-interval %v, must not be negative", s.opts.KubeconfigReloadInterval)
+	}
+	if err := s.setupClusters(); err != nil {
+		return nil, err
+	}
+
+	if s.audit, err = s.setupAudit(s.opts.AuditLog, s.opts.AuditWebhook); err != nil {
+		return nil, err
+	}
+
+	if s.tlsConfig, err = s.newTLSConfig(s.opts.TLSCert, s.opts.TLSKey, s.opts.TLSMinVersion); err != nil {
+		return nil, err
+	}
+
+	if len(s.opts.PolicyFile) != 0 {
+		s.policy.path = s.opts.PolicyFile
+		if err := s.policy.load(); err != nil {
+			return nil, err
+		}
+		if !s.opts.ValidateConfig {
+			s.policy.watch(s.ctx)
+		}
+	}
+
+	if s.opts.PassThroughToken && len(s.opts.AuthTokenFile) != 0 {
+		return nil, errors.New("-pass-through-token and -auth-token-file both read the bearer token, use one of them")
+	}
+	if len(s.opts.OIDCIssuerURL) != 0 && len(s.opts.AuthTokenFile) != 0 {
+		return nil, errors.New("-oidc-issuer-url and -auth-token-file both read the bearer token, use one of them")
+	}
+	if len(s.opts.AdminTokenFile) != 0 && len(s.opts.OIDCIssuerURL) != 0 {
+		return nil, errors.New("-admin-token-file tokens aren't ID tokens, use -oidc-admin-group with -oidc-issuer-url")
+	}
+	if len(s.opts.OIDCAdminGroup) != 0 && len(s.opts.OIDCIssuerURL) == 0 && s.opts.Authenticate == nil {
+		return nil, errors.New("-oidc-admin-group needs -oidc-issuer-url to authenticate users")
+	}
+	if s.opts.ImpersonateAuthenticated {
+		switch {
+		case len(s.opts.OIDCIssuerURL) == 0:
+			return nil, errors.New("-impersonate-authenticated needs -oidc-issuer-url to authenticate users")
+		case s.opts.EnableImpersonation:
+			return nil, errors.New("-impersonate-authenticated and -enable-impersonation both pick the impersonated user, use one of them")
+		case s.opts.PassThroughToken:
+			return nil, errors.New("-impersonate-authenticated calls the API server as the proxy, it can't be combined with -pass-through-token")
+		}
+	}
+
+	if s.authenticate, err = s.newAuthenticator(); err != nil {
+		return nil, err
+	}
+
+	s.sessions = newSessionRegistry(s.opts, s.observed)
+	s.upgradeLimits = newKeyedLimiter(s.opts.UpgradeRate, s.opts.UpgradeBurst)
+	s.handler = s.newHandler(s.newRouter(), s.authenticate)
+	return s, nil
+}
+
+//ServeHTTP serves the exec API, including the health, metrics and admin routes
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+//Run serves on -addr, and -grpc-addr when set, until SIGINT or SIGTERM drains the sessions, and then
+//closes the Server. With -validate-config it returns at once, the configuration having passed New.
+func (s *Server) Run() error {
+	defer s.Close()
+	if s.opts.ValidateConfig {
+		infof("configuration is valid")
+		return nil
+	}
+
+	if len(s.opts.OTLPEndpoint) != 0 {
+		flushTraces, err := setupTracing(s.opts.OTLPEndpoint, s.opts.OTLPInsecure, s.opts.TraceSampleRatio)
+		if err != nil {
+			return err
+		}
+		defer flushTraces()
+	}
+
+	server := &http.Server{
+		Addr:      s.opts.Addr,
+		Handler:   s.handler,
+		TLSConfig: s.tlsConfig,
+	}
+	return s.serve(server)
+}
+
+//Close stops reloading the files the Server loaded and posting its audit records. Sessions still running
+//are left alone, Run drains them before closing.
+func (s *Server) Close() error {
+	s.cancel()
+	return nil
+}
+
+//setupClusters serves the default cluster from the RESTConfig option, or else loads it and the -clusters
+//contexts from the kubeconfig and keeps reloading them
+func (s *Server) setupClusters() error {
+	if s.opts.RESTConfig != nil {
+		if len(s.opts.Clusters) != 0 {
+			return errors.New("-clusters are kubeconfig contexts, they can't be served with a RESTConfig")
+		}
+		cs, err := kubernetes.NewForConfig(s.opts.RESTConfig)
+		if err != nil {
+			return err
+		}
+		s.clusters.set(&cluster{config: s.opts.RESTConfig, clientset: cs}, make(map[string]*cluster))
+		return nil
+	}
+
+	path, explicit := s.opts.Kubeconfig, len(s.opts.Kubeconfig) != 0
+	if home := homeDir(); !explicit && home != "" {
+		path = filepath.Join(home, ".kube", "execConfig")
+	}
+	k := &kubeconfigReloader{clusters: s.clusters, path: path, explicit: explicit, inCluster: s.opts.InCluster, contexts: s.opts.Clusters}
+	if err := k.load(); err != nil {
+		return err
+	}
+	//The in-cluster config isn't reloaded, client-go rereads its service account token by itself
+	if !s.opts.InCluster && !s.opts.ValidateConfig {
+		k.watch(s.ctx, s.opts.KubeconfigReloadInterval)
+	}
+	return nil
+}
@@ -0,0 +1,883 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/scriptcoffee/k8s-proxy/proxy/execpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+//newTestServer serves a Server answering sessions with the echo executor. The API server it is
+//given is never reached, sessions naming their container need nothing from it.
+func newTestServer(t *testing.T, configure func(o *Options)) *httptest.Server {
+	t.Helper()
+	_, ts := newTestProxy(t, configure)
+	return ts
+}
+
+//newTestProxy is newTestServer also returning the Server, for tests looking at its state
+func newTestProxy(t *testing.T, configure func(o *Options)) (*Server, *httptest.Server) {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.ExecBackend = "echo"
+	opts.RESTConfig = &rest.Config{Host: "http://127.0.0.1:1"}
+	//Sessions wait this long for the client to close after the exit status
+	opts.CloseGrace = 50 * time.Millisecond
+	if configure != nil {
+		configure(&opts)
+	}
+	s, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	//Close doesn't wait for the handlers of hijacked connections, the next test must not find them running
+	var handlers sync.WaitGroup
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		order := &responseOrder{ResponseWriter: w}
+		s.ServeHTTP(order, r)
+		if order.err != nil {
+			t.Errorf("%s %s: %v", r.Method, r.URL.Path, order.err)
+		}
+	}))
+	t.Cleanup(func() {
+		ts.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.sessions.wait(ctx); err != nil {
+			t.Errorf("sessions still running: %v", err)
+		}
+		handlers.Wait()
+		s.Close()
+	})
+	return s, ts
+}
+
+//newPodAPI serves pods as an API server would, answering anything else with 404, and returns its URL
+func newPodAPI(t *testing.T, pods ...*corev1.Pod) string {
+	t.Helper()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, pod := range pods {
+			if r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/"+pod.Namespace+"/pods/"+pod.Name+"/log" {
+				fmt.Fprintf(w, "log of %s\n", r.URL.Query().Get("container"))
+				return
+			}
+			if r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/"+pod.Namespace+"/pods/"+pod.Name {
+				pod.APIVersion, pod.Kind = "v1", "Pod"
+				writeJSON(w, http.StatusOK, pod)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, metav1.Status{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+			Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})
+	}))
+	t.Cleanup(api.Close)
+	return api.URL
+}
+
+//testPod returns pod web-0 of the default namespace running containers of the given names
+func testPod(containers ...string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-0"}}
+	for _, name := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name, Image: "busybox"})
+	}
+	return pod
+}
+
+//dialExec opens an exec session running cat in web-0 over the v5 channel protocol, with the params in query added
+func dialExec(ts *httptest.Server, query string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/v1/namespaces/default/pods/web-0/exec?container=app&command=cat&tty=false" + query
+	dialer := websocket.Dialer{Subprotocols: []string{"v5.channel.k8s.io"}, HandshakeTimeout: 5 * time.Second}
+	return dialer.Dial(u, header)
+}
+
+//echo sends data as stdin, expects it back on stdout, then closes stdin and waits for the exit status
+func echo(t *testing.T, ws *websocket.Conn, data string) {
+	t.Helper()
+	err := echoOutput(ws, data)
+	if err == nil {
+		err = echoExit(ws)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//echoOutput sends data as stdin and expects it back on stdout
+func echoOutput(ws *websocket.Conn, data string) error {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := ws.WriteMessage(websocket.BinaryMessage, append([]byte{0}, data...)); err != nil {
+		return fmt.Errorf("writing stdin: %v", err)
+	}
+	var out []byte
+	for len(out) < len(data) {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("reading stdout: %v", err)
+		}
+		if len(msg) == 0 || msg[0] != 1 {
+			return fmt.Errorf("got frame %q, want stdout", msg)
+		}
+		out = append(out, msg[1:]...)
+	}
+	if string(out) != data {
+		return fmt.Errorf("got stdout %q, want %q", out, data)
+	}
+	return nil
+}
+
+//echoExit closes stdin and expects a successful exit status
+func echoExit(ws *websocket.Conn) error {
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte{0xff, 0}); err != nil {
+		return fmt.Errorf("closing stdin: %v", err)
+	}
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("reading exit status: %v", err)
+	}
+	if len(msg) == 0 || msg[0] != 3 || !bytes.Contains(msg, []byte(`"Success"`)) {
+		return fmt.Errorf("got frame %q, want a successful exit status", msg)
+	}
+	return nil
+}
+
+func TestHealthz(t *testing.T) {
+	ts := newTestServer(t, nil)
+	resp, err := http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestExecEcho(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ws, _, err := dialExec(ts, "", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	echo(t, ws, "hello\n")
+}
+
+func TestCompressionRatio(t *testing.T) {
+	s, ts := newTestProxy(t, func(o *Options) { o.Compression = true })
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/v1/namespaces/default/pods/web-0/exec?container=app&command=cat&tty=false"
+	dialer := websocket.Dialer{Subprotocols: []string{"v5.channel.k8s.io"}, HandshakeTimeout: 5 * time.Second, EnableCompression: true}
+	deflated, _, err := dialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer deflated.Close()
+	plain, _, err := dialExec(ts, "", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer plain.Close()
+
+	data := strings.Repeat("the same line, over and over\n", 250)
+	for _, ws := range []*websocket.Conn{deflated, plain} {
+		if err := echoOutput(ws, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	infos := s.sessions.list()
+	if len(infos) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(infos))
+	}
+	compressed, uncompressed := infos[0], infos[1]
+	if compressed.WireBytesOut == 0 {
+		compressed, uncompressed = uncompressed, compressed
+	}
+	if uncompressed.WireBytesIn != 0 || uncompressed.WireBytesOut != 0 || uncompressed.CompressionRatio != 0 {
+		t.Errorf("uncompressed session reported compression: %+v", uncompressed)
+	}
+	if compressed.WireBytesIn == 0 || compressed.WireBytesOut == 0 || compressed.CompressionRatio < 10 {
+		t.Errorf("compressed session: got wire bytes %d in, %d out and ratio %v for %d payload bytes", compressed.WireBytesIn,
+			compressed.WireBytesOut, compressed.CompressionRatio, compressed.BytesIn+compressed.BytesOut)
+	}
+
+	for _, ws := range []*websocket.Conn{deflated, plain} {
+		if err := echoExit(ws); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//newTestGRPCClient serves ExecService of a Server answering sessions with the echo executor, returning it
+//and a client of it
+func newTestGRPCClient(t *testing.T, configure func(o *Options)) (*Server, execpb.ExecServiceClient) {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.ExecBackend = "echo"
+	opts.RESTConfig = &rest.Config{Host: "http://127.0.0.1:1"}
+	if configure != nil {
+		configure(&opts)
+	}
+	s, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := s.newGRPCServer(nil, s.authenticate)
+	go server.Serve(ln)
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := stopGRPC(ctx, server); err != nil {
+			t.Errorf("stopping the gRPC server: %v", err)
+		}
+		if err := s.sessions.wait(ctx); err != nil {
+			t.Errorf("sessions still running: %v", err)
+		}
+		s.Close()
+	})
+	return s, execpb.NewExecServiceClient(conn)
+}
+
+func TestGRPCExecEcho(t *testing.T) {
+	_, client := newTestGRPCClient(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := &execpb.Start{Namespace: "default", Pod: "web-0", Container: "app", Command: []string{"cat"}, Stdin: true}
+	for _, req := range []*execpb.ExecRequest{
+		{Message: &execpb.ExecRequest_Start{Start: start}},
+		{Message: &execpb.ExecRequest_Stdin{Stdin: []byte("hello\n")}},
+	} {
+		if err := stream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout []byte
+	for len(stdout) < len("hello\n") {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("reading stdout: %v", err)
+		}
+		stdout = append(stdout, resp.GetStdout()...)
+	}
+	if string(stdout) != "hello\n" {
+		t.Fatalf("got stdout %q, want %q", stdout, "hello\n")
+	}
+
+	if err := stream.Send(&execpb.ExecRequest{Message: &execpb.ExecRequest_CloseStdin{CloseStdin: true}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("reading the exit status: %v", err)
+	}
+	if resp.GetExit() == nil || resp.GetExit().GetCode() != 0 {
+		t.Fatalf("got %v, want exit code 0", resp)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("after the exit status: got %v, want EOF", err)
+	}
+}
+
+func TestGRPCKilledSession(t *testing.T) {
+	s, client := newTestGRPCClient(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := &execpb.Start{Namespace: "default", Pod: "web-0", Container: "app", Command: []string{"cat"}, Stdin: true}
+	if err := stream.Send(&execpb.ExecRequest{Message: &execpb.ExecRequest_Start{Start: start}}); err != nil {
+		t.Fatal(err)
+	}
+	header, err := stream.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := header.Get(strings.ToLower(sessionIDHeader))
+	if len(id) != 1 {
+		t.Fatalf("got session ID header %v", id)
+	}
+
+	//The call ends while the client still holds it open, the handler doesn't wait for its next message
+	for !s.sessions.kill(id[0], "test over") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Aborted {
+		t.Fatalf("got %v, want the session aborted", err)
+	}
+}
+
+func TestGRPCMaxMessageSize(t *testing.T) {
+	_, client := newTestGRPCClient(t, func(o *Options) { o.MaxMessageSize = 1024 })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := &execpb.Start{Namespace: "default", Pod: "web-0", Container: "app", Command: []string{"cat"}, Stdin: true}
+	if err := stream.Send(&execpb.ExecRequest{Message: &execpb.ExecRequest_Start{Start: start}}); err != nil {
+		t.Fatal(err)
+	}
+	//Send fails with io.EOF once the server ended the call, Recv has its status
+	stream.Send(&execpb.ExecRequest{Message: &execpb.ExecRequest_Stdin{Stdin: make([]byte, 2048)}})
+	for {
+		_, err := stream.Recv()
+		if err == nil {
+			continue
+		}
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("got %v, want the message rejected for its size", err)
+		}
+		break
+	}
+}
+
+func TestAuthTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, func(o *Options) { o.AuthTokenFile = path })
+
+	_, resp, err := dialExec(ts, "", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial without a token: got %v, want 401", err)
+	}
+	resp, err = http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("healthz without a token: got status %d, want 200", resp.StatusCode)
+	}
+
+	ws, _, err := dialExec(ts, "", http.Header{"Authorization": {"Bearer s3cret"}})
+	if err != nil {
+		t.Fatalf("dial with a token: %v", err)
+	}
+	defer ws.Close()
+	echo(t, ws, "hello\n")
+}
+
+func TestAuthenticateAndAuditHooks(t *testing.T) {
+	records := make(chan AuditRecord, 1)
+	ts := newTestServer(t, func(o *Options) {
+		o.Authenticate = func(r *http.Request) (string, []string, error) {
+			if r.Header.Get("X-Test-User") == "" {
+				return "", nil, errors.New("no user")
+			}
+			return r.Header.Get("X-Test-User"), []string{"devs"}, nil
+		}
+		o.Audit = func(record AuditRecord) { records <- record }
+	})
+
+	_, resp, err := dialExec(ts, "", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial rejected by the hook: got %v, want 401", err)
+	}
+
+	ws, _, err := dialExec(ts, "", http.Header{"X-Test-User": {"alice"}})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	echo(t, ws, "hello\n")
+
+	select {
+	case record := <-records:
+		if record.User != "alice" || len(record.Groups) != 1 || record.Groups[0] != "devs" {
+			t.Errorf("got user %q groups %q, want alice [devs]", record.User, record.Groups)
+		}
+		if record.Pod != "web-0" || record.Container != "app" || strings.Join(record.Command, " ") != "cat" {
+			t.Errorf("got target %s/%s command %q, want web-0/app cat", record.Pod, record.Container, record.Command)
+		}
+		if record.Reason != "command exited exitCode=0" {
+			t.Errorf("got reason %q, want a clean exit", record.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no audit record")
+	}
+}
+
+func TestNewRejectsInvalidOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ExecBackend = "echo"
+	opts.RESTConfig = &rest.Config{Host: "http://127.0.0.1:1"}
+	opts.MaxMessageSize = 1
+	if _, err := New(opts); err == nil {
+		t.Fatal("New accepted -max-message-size 1")
+	}
+
+	//Checked with the other flags, so -validate-config reports it
+	opts.MaxMessageSize = DefaultOptions().MaxMessageSize
+	opts.TraceSampleRatio = 2
+	opts.ValidateConfig = true
+	if _, err := New(opts); err == nil {
+		t.Fatal("New accepted -trace-sample-ratio 2")
+	}
+}
+
+//testKubeconfig points the default context at an API server that is never reached
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: http://127.0.0.1:1
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`
+
+func TestValidateConfigIsDryRun(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	opts := DefaultOptions()
+	opts.ValidateConfig = true
+	opts.ExecBackend = "echo"
+	opts.Kubeconfig = write("kubeconfig", testKubeconfig)
+	opts.KubeconfigReloadInterval = time.Minute
+	opts.AuthTokenFile = write("tokens", "s3cret\n")
+	opts.PolicyFile = write("policy.yaml", "")
+	opts.AuditLog = filepath.Join(dir, "audit.log")
+	opts.AuditWebhook = "http://127.0.0.1:1/audit"
+
+	before := runtime.NumGoroutine()
+	if _, err := New(opts); err != nil {
+		t.Fatal(err)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("-validate-config started %d goroutines", after-before)
+	}
+	if _, err := os.Stat(opts.AuditLog); !os.IsNotExist(err) {
+		t.Errorf("-validate-config created the audit log: %v", err)
+	}
+
+	opts.AuditLog = filepath.Join(dir, "missing", "audit.log")
+	if _, err := New(opts); err == nil {
+		t.Error("-validate-config accepted an audit log in a missing directory")
+	}
+}
+
+func TestCloseStopsReloaders(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	opts := DefaultOptions()
+	opts.ExecBackend = "echo"
+	opts.Kubeconfig = write("kubeconfig", testKubeconfig)
+	opts.KubeconfigReloadInterval = time.Minute
+	opts.AuthTokenFile = write("tokens", "s3cret\n")
+	opts.AdminTokenFile = write("admins", "admin-s3cret\n")
+	opts.PolicyFile = write("policy.yaml", "")
+	opts.AuditWebhook = "http://127.0.0.1:1/audit"
+
+	//Goroutines started once per process, like the signal loop of os/signal, aren't left by a Server
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	before := runtime.NumGoroutine()
+	if s, err = New(opts); err != nil {
+		t.Fatal(err)
+	}
+	if started := runtime.NumGoroutine(); started <= before {
+		t.Fatal("New started no reloaders")
+	}
+	s.Close()
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(5 * time.Second); after > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > before {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("%d goroutines left running after Close:\n%s", after-before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+//TestServersDontShareState runs Servers with different options side by side, each applying only its own
+//commands, policy and session limits
+func TestServersDontShareState(t *testing.T) {
+	restricted, rts := newTestProxy(t, func(o *Options) {
+		o.AllowedCommands = "/bin/sh"
+		o.PolicyFile = writePolicy(t, `commands: ["/bin/sh"]`)
+		o.MaxSessions = 1
+	})
+	open, ots := newTestProxy(t, func(o *Options) {
+		o.PolicyFile = writePolicy(t, `commands: ["cat"]`)
+	})
+
+	//Another client holds the only session slot of the restricted Server
+	if err := restricted.sessions.reserve("192.0.2.1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, resp, err := dialExec(rts, "", nil); err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("over -max-sessions: got %v, want 429", err)
+	}
+	ws, _, err := dialExec(ots, "", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	if err := echoOutput(ws, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, count := restricted.sessions.status(); count != 0 {
+		t.Errorf("the restricted Server lists %d sessions of the other", count)
+	}
+	if _, count := open.sessions.status(); count != 1 {
+		t.Errorf("got %d sessions, want 1", count)
+	}
+	if err := echoExit(ws); err != nil {
+		t.Fatal(err)
+	}
+	restricted.sessions.release("192.0.2.1", "")
+
+	//cat is neither in -allowed-commands nor in the policy of the restricted Server
+	ws, _, err = dialExec(rts, "", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	expectClose(t, ws, websocket.ClosePolicyViolation)
+}
+
+func TestAdminRoutes(t *testing.T) {
+	ts := newTestServer(t, nil)
+	resp, err := http.Get(ts.URL + "/admin/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("admin routes without admin flags: got status %d, want 403", resp.StatusCode)
+	}
+
+	path := filepath.Join(t.TempDir(), "admins")
+	if err := os.WriteFile(path, []byte("admin-s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, ts := newTestProxy(t, func(o *Options) {
+		o.AdminTokenFile = path
+		o.DetachTimeout = time.Minute
+	})
+	admin := func(method, path, token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		if len(token) != 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	for _, token := range []string{"", "wrong"} {
+		if resp := admin(http.MethodGet, "/admin/sessions", token); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("admin routes with token %q: got status %d, want 403", token, resp.StatusCode)
+		}
+	}
+
+	//A detachable session stays listed, and can be killed, once its client is gone
+	ws, resp, err := dialExec(ts, "&detach=0123456789abcdef0123", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	id := resp.Header.Get(sessionIDHeader)
+	ws.Close()
+
+	var listed []sessionInfo
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := admin(http.MethodGet, "/admin/sessions", "admin-s3cret")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("listing sessions: got status %d, want 200", resp.StatusCode)
+		}
+		listed = nil
+		if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) == 1 && listed[0].Detached || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(listed) != 1 || listed[0].ID != id || !listed[0].Detached {
+		t.Fatalf("got sessions %+v, want detached session %s", listed, id)
+	}
+
+	if resp := admin(http.MethodDelete, "/admin/sessions/"+id, "admin-s3cret"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("killing the detached session: got status %d, want 204", resp.StatusCode)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.sessions.wait(ctx); err != nil {
+		t.Fatalf("killed session still running: %v", err)
+	}
+}
+
+func TestShareSession(t *testing.T) {
+	s, ts := newTestProxy(t, func(o *Options) {
+		o.Authenticate = func(r *http.Request) (string, []string, error) {
+			return r.Header.Get("X-Test-User"), nil, nil
+		}
+	})
+	as := func(user string) http.Header { return http.Header{"X-Test-User": {user}} }
+	share := func(id, user string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/sessions/"+id+"/share", nil)
+		req.Header = as(user)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	ws, resp, err := dialExec(ts, "", as("alice"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	id := resp.Header.Get(sessionIDHeader)
+
+	if resp := share(id, "bob"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("sharing another user's session: got status %d, want 403", resp.StatusCode)
+	}
+	resp = share(id, "alice")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("sharing: got status %d, want 201", resp.StatusCode)
+	}
+	var shared shareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&shared); err != nil {
+		t.Fatal(err)
+	}
+
+	observer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+shared.Path, as("bob"))
+	if err != nil {
+		t.Fatalf("dial observer: %v", err)
+	}
+	defer observer.Close()
+	//The observer is registered right after its upgrade
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, count := s.sessions.status(); count == 2 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("got %d live sessions, want the session and its observer", count)
+		}
+	}
+
+	echo(t, ws, "hello\n")
+	observer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := observer.ReadMessage()
+	if err != nil {
+		t.Fatalf("observer: %v", err)
+	}
+	if string(msg) != "1"+base64.StdEncoding.EncodeToString([]byte("hello\n")) {
+		t.Fatalf("observer got frame %q, want the session's output", msg)
+	}
+	for {
+		if _, _, err := observer.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
+
+func TestWhichChecksAllowedCommands(t *testing.T) {
+	for _, tc := range []struct {
+		allowed string
+		status  int
+	}{
+		{"", http.StatusOK},
+		{"/bin/sh", http.StatusOK},
+		{"/bin/bash", http.StatusForbidden},
+	} {
+		ts := newTestServer(t, func(o *Options) { o.AllowedCommands = tc.allowed })
+		resp, err := http.Get(ts.URL + "/api/v1/namespaces/default/pods/web-0/which?container=app&cmd=bash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("-allowed-commands %q: got status %d, want %d", tc.allowed, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestReattachOwner(t *testing.T) {
+	s, ts := newTestProxy(t, func(o *Options) {
+		o.DetachTimeout = time.Minute
+		o.MaxSessionsPerUser = 1
+		o.Authenticate = func(r *http.Request) (string, []string, error) {
+			return r.Header.Get("X-Test-User"), nil, nil
+		}
+	})
+	as := func(user string) http.Header { return http.Header{"X-Test-User": {user}} }
+	const detach = "&detach=0123456789abcdef0123"
+
+	ws, _, err := dialExec(ts, detach, as("alice"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	ws.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if list := s.sessions.list(); len(list) == 1 && list[0].Detached {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("got sessions %+v, want one detached", list)
+		}
+	}
+
+	if _, resp, err := dialExec(ts, detach, as("bob")); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("reattaching as another user: got %v, want 403", err)
+	}
+	//The detached session still holds alice's only slot
+	if _, resp, err := dialExec(ts, "&detach=fedcba9876543210fedc", as("alice")); err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second session over -max-sessions-per-user: got %v, want 429", err)
+	}
+
+	ws, resp, err := dialExec(ts, detach, as("alice"))
+	if err != nil {
+		t.Fatalf("reattaching as the owner: %v", err)
+	}
+	defer ws.Close()
+	//Stdin of a detachable session outlives its clients, so the session is stopped rather than ended by closing it
+	if err := echoOutput(ws, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	s.sessions.kill(resp.Header.Get(sessionIDHeader), "test over")
+}
+
+func TestSessionsLeaveNoGoroutines(t *testing.T) {
+	s, ts := newTestProxy(t, func(o *Options) {
+		o.CloseGrace = time.Millisecond
+		o.LogLevel = "error"
+	})
+	session := func() error {
+		ws, _, err := dialExec(ts, "", nil)
+		if err != nil {
+			return err
+		}
+		defer ws.Close()
+		if err := echoOutput(ws, "hello\n"); err != nil {
+			return err
+		}
+		return echoExit(ws)
+	}
+	//Goroutines started once, by the first session or the listener, aren't growth
+	if err := session(); err != nil {
+		t.Fatal(err)
+	}
+	//Goroutine counts are read once they stopped changing, or no longer exceed want
+	settled := func(want int) int {
+		n := runtime.NumGoroutine()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+			time.Sleep(50 * time.Millisecond)
+			prev := n
+			if n = runtime.NumGoroutine(); n <= want || n == prev && want < 0 {
+				break
+			}
+		}
+		return n
+	}
+	before := settled(-1)
+
+	const total, parallel = 1000, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, total)
+	next := make(chan struct{})
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range next {
+				if err := session(); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for i := 0; i < total; i++ {
+		next <- struct{}{}
+	}
+	close(next)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("session: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.sessions.wait(ctx); err != nil {
+		t.Fatalf("sessions still running: %v", err)
+	}
+	//Closed client connections and their server side take a moment to wind down
+	if after := settled(before); after > before {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("%d goroutines after %d sessions, %d before:\n%s", after, total, before, buf[:runtime.Stack(buf, true)])
+	}
+}
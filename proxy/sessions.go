@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//sessionRegistry tracks live ws and gRPC sessions so they can be counted, limited, listed and drained.
+//Connections are a *websocket.Conn, a *grpcSession, a *cpSession or a *detachableSession, registered until
+//its stream ends whether a client is attached or not.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	conns    map[io.Closer]*sessionLogger
+	draining bool
+	reserved int
+	perIP    map[string]int
+	perUser  map[string]int
+
+	//Limits and timeouts from the options of the Server
+	maxSessions  int
+	perIPLimit   int
+	perUserLimit int
+	writeWait    time.Duration
+	closeGrace   time.Duration
+
+	//Observers of killed sessions are disconnected with them
+	observed *observerRegistry
+}
+
+func newSessionRegistry(opts Options, observed *observerRegistry) *sessionRegistry {
+	return &sessionRegistry{
+		conns:        make(map[io.Closer]*sessionLogger),
+		perIP:        make(map[string]int),
+		perUser:      make(map[string]int),
+		maxSessions:  opts.MaxSessions,
+		perIPLimit:   opts.MaxSessionsPerIP,
+		perUserLimit: opts.MaxSessionsPerUser,
+		writeWait:    opts.WriteTimeout,
+		closeGrace:   opts.CloseGrace,
+		observed:     observed,
+	}
+}
+
+//reserve claims a session slot for ip and user before the upgrade, returning why it can't when the
+//-max-sessions, -max-sessions-per-ip or -max-sessions-per-user limit is reached. An empty user is
+//only limited by the other two. Claimed slots must be released.
+func (s *sessionRegistry) reserve(ip, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSessions > 0 && s.reserved >= s.maxSessions {
+		return errors.New("too many sessions")
+	}
+	if s.perIPLimit > 0 && s.perIP[ip] >= s.perIPLimit {
+		return fmt.Errorf("too many sessions from %s", ip)
+	}
+	if len(user) != 0 && s.perUserLimit > 0 && s.perUser[user] >= s.perUserLimit {
+		return fmt.Errorf("too many sessions for user %s", user)
+	}
+	s.reserved++
+	s.perIP[ip]++
+	if len(user) != 0 {
+		s.perUser[user]++
+	}
+	return nil
+}
+
+func (s *sessionRegistry) release(ip, user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reserved--
+	if s.perIP[ip]--; s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+	if len(user) != 0 {
+		if s.perUser[user]--; s.perUser[user] <= 0 {
+			delete(s.perUser, user)
+		}
+	}
+}
+
+//add registers conn as a live session described by logger, refusing it once draining has started
+func (s *sessionRegistry) add(conn io.Closer, logger *sessionLogger) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+	s.conns[conn] = logger
+	return true
+}
+
+func (s *sessionRegistry) remove(conn io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+//askClose asks the client of conn to disconnect, with a ws close code and reason
+func (s *sessionRegistry) askClose(conn io.Closer, code int, reason string) {
+	switch c := conn.(type) {
+	case *websocket.Conn:
+		//WriteControl is safe to call concurrently with the session's writer
+		c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(s.writeWait))
+	case *grpcSession:
+		c.closeSession(code, reason)
+	case *detachableSession:
+		c.stop(code, reason)
+	case *cpSession:
+		//Copies can't be asked to stop, so a drain lets them finish while anything else cuts them off
+		if code != websocket.CloseGoingAway {
+			c.Close()
+		}
+	}
+}
+
+//drain stops accepting sessions and asks every live client to disconnect
+func (s *sessionRegistry) drain(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.draining = true
+	for conn := range s.conns {
+		s.askClose(conn, websocket.CloseGoingAway, reason)
+	}
+}
+
+//sessionInfo describes a live session in the admin sessions list
+type sessionInfo struct {
+	ID          string    `json:"id"`
+	Endpoint    string    `json:"endpoint"`
+	Cluster     string    `json:"cluster,omitempty"`
+	User        string    `json:"user,omitempty"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	Namespace   string    `json:"namespace"`
+	Pod         string    `json:"pod"`
+	Container   string    `json:"container,omitempty"`
+	Command     []string  `json:"command,omitempty"`
+	Start       time.Time `json:"start"`
+	IdleSeconds float64   `json:"idleSeconds"`
+	BytesIn     int64     `json:"bytesIn"`
+	BytesOut    int64     `json:"bytesOut"`
+	Detached    bool      `json:"detached,omitempty"`
+
+	//Only set for sessions that negotiated compression: the bytes on the wire and the payload bytes
+	//carried per wire byte
+	WireBytesIn      int64   `json:"wireBytesIn,omitempty"`
+	WireBytesOut     int64   `json:"wireBytesOut,omitempty"`
+	CompressionRatio float64 `json:"compressionRatio,omitempty"`
+}
+
+//list describes every live session, oldest first
+func (s *sessionRegistry) list() []sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]sessionInfo, 0, len(s.conns))
+	for conn, l := range s.conns {
+		d, detachable := conn.(*detachableSession)
+		wireIn, wireOut := atomic.LoadInt64(&l.wireIn), atomic.LoadInt64(&l.wireOut)
+		var ratio float64
+		if wire := wireIn + wireOut; wire != 0 {
+			ratio = float64(atomic.LoadInt64(&l.bytesIn)+atomic.LoadInt64(&l.bytesOut)) / float64(wire)
+		}
+		infos = append(infos, sessionInfo{
+			ID:          l.id,
+			Endpoint:    l.record.Endpoint,
+			Cluster:     l.record.Cluster,
+			User:        l.record.User,
+			RemoteAddr:  l.record.RemoteAddr,
+			Namespace:   l.record.Namespace,
+			Pod:         l.record.Pod,
+			Container:   l.record.Container,
+			Command:     l.record.Command,
+			Start:       l.start,
+			IdleSeconds: l.idle().Seconds(),
+			BytesIn:     atomic.LoadInt64(&l.bytesIn),
+			BytesOut:    atomic.LoadInt64(&l.bytesOut),
+			Detached:    detachable && !d.attached(),
+
+			WireBytesIn:      wireIn,
+			WireBytesOut:     wireOut,
+			CompressionRatio: ratio,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+	return infos
+}
+
+//kill asks the session with id to disconnect, force closing it if the client doesn't
+//respond within -close-grace. It returns false when no such session is live.
+func (s *sessionRegistry) kill(id, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, l := range s.conns {
+		if l.id != id {
+			continue
+		}
+		l.infof("terminating session: %s", reason)
+		s.observed.revoke(id, reason)
+		s.askClose(conn, websocket.ClosePolicyViolation, reason)
+		time.AfterFunc(s.closeGrace, func() { conn.Close() })
+		return true
+	}
+	return false
+}
+
+//status reports whether the server is draining and how many sessions are still live
+func (s *sessionRegistry) status() (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.draining, len(s.conns)
+}
+
+//wait blocks until every session has ended or ctx is done
+func (s *sessionRegistry) wait(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if _, count := s.status(); count == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+//Container runtime errors meaning the binary doesn't exist, as opposed to the exec failing
+var notFoundPattern = regexp.MustCompile(`(?i)not found|no such file|cannot find`)
+
+//parseShells parses the comma separated -shells list of shells probed in order for sessions without
+//a command. Empty runs /bin/sh -i.
+func parseShells(list string) []string {
+	var shells []string
+	for _, shell := range strings.Split(list, ",") {
+		shell = strings.TrimSpace(shell)
+		if len(shell) != 0 {
+			shells = append(shells, shell)
+		}
+	}
+	return shells
+}
+
+//shellCommands returns the command starting shell interactively and one that only checks it runs
+func shellCommands(shell string) (interactive, probe []string) {
+	switch name := strings.ToLower(path.Base(shell)); {
+	case name == "cmd.exe":
+		return []string{shell}, []string{shell, "/c", "exit", "0"}
+	case strings.HasSuffix(name, ".exe"):
+		//powershell.exe and pwsh.exe
+		return []string{shell}, []string{shell, "-Command", "exit 0"}
+	default:
+		return []string{shell, "-i"}, []string{shell, "-c", "exit 0"}
+	}
+}
+
+//probeShell returns the interactive command of the first shell of -shells that exists in the container.
+//Shells the allowed commands or the policy reject are skipped without being run.
+func (s *Server) probeShell(r *http.Request, namespace, podName, containerName string) ([]string, error) {
+	var rejected error
+	for _, shell := range s.shellChain {
+		interactive, probe := shellCommands(shell)
+		command, err := s.execCommand(interactive)
+		if err == nil {
+			err = s.policy.check(r.Context(), s.requestCluster(r).clientset, namespace, podName, containerName, command)
+		}
+		if err != nil {
+			rejected = err
+			continue
+		}
+
+		found, err := s.shellExists(r, namespace, podName, containerName, probe)
+		if err != nil {
+			return nil, fmt.Errorf("probing %s: %v", shell, err)
+		}
+		if found {
+			debugf("shell probe: using %s in %s/%s", shell, namespace, podName)
+			return command, nil
+		}
+	}
+
+	if rejected != nil {
+		return nil, fmt.Errorf("no allowed shell of %s exists in the container: %v", strings.Join(s.shellChain, ", "), rejected)
+	}
+	return nil, fmt.Errorf("none of the shells %s exists in the container", strings.Join(s.shellChain, ", "))
+}
+
+//shellExists runs probe without a tty, reporting false when the runtime can't find its binary
+func (s *Server) shellExists(r *http.Request, namespace, podName, containerName string, probe []string) (bool, error) {
+	req := s.newExecRequest(s.requestCluster(r).clientset, namespace, podName, containerName, probe, false, false)
+	executor, err := s.newExecutor(s.requestConfig(r), s.opts.ExecMethod, req.URL())
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), whichTimeout)
+	defer cancel()
+
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: io.Discard,
+		Stderr: io.Discard,
+	})
+
+	//The shell ran, whatever its exit status
+	if _, ok := exitCode(err); ok {
+		return true, nil
+	}
+	if ctx.Err() == nil && notFoundPattern.MatchString(err.Error()) {
+		return false, nil
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return false, fmt.Errorf("no answer within %s", whichTimeout)
+	}
+	return false, err
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"google.golang.org/grpc"
+)
+
+//serve runs the server, and the gRPC server when -grpc-addr is set, until SIGINT or SIGTERM or until either
+//fails, then asks live sessions to close and waits up to -shutdown-timeout for them and in-flight requests to
+//finish. A failure is returned once both servers are stopped.
+func (s *Server) serve(server *http.Server) error {
+	ln, err := listen(server.Addr)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 2)
+	go func() {
+		if server.TLSConfig != nil {
+			//The certificate comes from TLSConfig.GetCertificate
+			errCh <- server.ServeTLS(ln, "", "")
+		} else {
+			errCh <- server.Serve(ln)
+		}
+	}()
+
+	var grpcServer *grpc.Server
+	if len(s.opts.GRPCAddr) != 0 {
+		grpcLn, err := listen(s.opts.GRPCAddr)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		//Serve may not have taken the listener yet when a failure stops the server
+		defer grpcLn.Close()
+		grpcServer = s.newGRPCServer(s.tlsConfig, s.authenticate)
+		go func() {
+			errCh <- grpcServer.Serve(grpcLn)
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case err := <-errCh:
+		//The other server and live sessions still need stopping, a failed server must not leave them behind
+		errorf("server failed, shutting down: %v", err)
+		if err := s.shutdown(server, grpcServer); err != nil {
+			errorf("%v", err)
+		}
+		return err
+	case received := <-sig:
+		infof("received %s, shutting down", received)
+	}
+	return s.shutdown(server, grpcServer)
+}
+
+//shutdown drains live sessions and stops server and grpcServer, if any, waiting up to -shutdown-timeout
+func (s *Server) shutdown(server *http.Server, grpcServer *grpc.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+	defer cancel()
+
+	//Hijacked ws connections aren't tracked by Shutdown, so drain them separately
+	s.sessions.drain("server shutting down")
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutdown: %v", err)
+	}
+	if grpcServer != nil {
+		if err := stopGRPC(ctx, grpcServer); err != nil {
+			return fmt.Errorf("shutdown: %v", err)
+		}
+	}
+	if err := s.sessions.wait(ctx); err != nil {
+		return fmt.Errorf("shutdown: %v", err)
+	}
+	return nil
+}
+
+//stopGRPC stops the gRPC server from taking calls and waits for the running ones, drained already, to
+//end. Calls still running when ctx is done are cut off.
+func stopGRPC(ctx context.Context, server *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		<-stopped
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//TestServeFailureShutsDown fails the HTTP server, which has no certificate, and expects the gRPC server
+//stopped and sessions drained before the failure is returned
+func TestServeFailureShutsDown(t *testing.T) {
+	grpcSocket := filepath.Join(t.TempDir(), "grpc.sock")
+	s, _ := newTestProxy(t, func(o *Options) { o.GRPCAddr = unixScheme + grpcSocket })
+
+	server := &http.Server{Addr: "127.0.0.1:0", TLSConfig: &tls.Config{}}
+	done := make(chan error, 1)
+	go func() { done <- s.serve(server) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve didn't return after the server failed")
+	}
+	if err == nil {
+		t.Fatal("serve returned no error")
+	}
+
+	if conn, err := net.Dial("unix", grpcSocket); err == nil {
+		conn.Close()
+		t.Error("the gRPC server still listens")
+	}
+	if s.sessions.add(io.NopCloser(nil), nil) {
+		t.Error("sessions weren't drained")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("the HTTP server wasn't shut down: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often the certificate files are checked for changes.
+const certPollInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//newTLSConfig validates the TLS flags and loads the certificate, returning nil when TLS is disabled.
+//The certificate is served through GetCertificate so rotations are picked up without a restart, until the
+//Server is closed.
+func (s *Server) newTLSConfig(certFile, keyFile, minVersion string) (*tls.Config, error) {
+	if len(certFile) == 0 && len(keyFile) == 0 {
+		return nil, nil
+	}
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	}
+
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported -tls-min-version %q, must be 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	//A dry run only checks the key pair
+	if !s.opts.ValidateConfig {
+		certs.watch(s.ctx)
+	}
+	return &tls.Config{MinVersion: version, GetCertificate: certs.getCertificate}, nil
+}
+
+//certReloader holds the serving certificate, reloading it on SIGHUP or when its files change
+type certReloader struct {
+	mu       sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+//watch reloads the key pair on SIGHUP or when polling finds its files changed, until ctx is done
+func (c *certReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(certPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			case <-ticker.C:
+				if !c.changed() {
+					continue
+				}
+			}
+			if err := c.load(); err != nil {
+				errorf("tls: keeping previous certificate, reload failed: %v", err)
+				continue
+			}
+			infof("tls: reloaded %s", c.certFile)
+		}
+	}()
+}
+
+//load reads the key pair, replacing the served certificate only if both files parse
+func (c *certReloader) load() error {
+	modTime := c.latestModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS key pair: %v", err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	return nil
+}
+
+//latestModTime returns the most recent modification time of the key pair files.
+//Stat follows symlinks, so secret volume updates swapping a link are seen too.
+func (c *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (c *certReloader) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.latestModTime().Equal(c.modTime)
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"k8s.io/client-go/rest"
+)
+
+// Time allowed to flush pending spans on shutdown.
+const tracingShutdownTimeout = 5 * time.Second
+
+//Creates the proxy's spans. It does nothing until setupTracing installs an exporting provider.
+var tracer = otel.Tracer("k8s-proxy")
+
+//Whether setupTracing enabled tracing, so untraced requests skip copying configs
+var tracingEnabled bool
+
+//setupTracing exports spans over OTLP/HTTP to endpoint, host:port of a collector, sampling ratio of the
+//traces that don't come with a sampling decision from the client. The returned func flushes the spans.
+func setupTracing(endpoint string, insecure bool, ratio float64) (func(), error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "k8s-proxy")))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracingEnabled = true
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			errorf("tracing: %v", err)
+		}
+	}, nil
+}
+
+//traceRequests starts a span for every request, continuing the trace of a traceparent header. For ws
+//sessions it lasts until the session ends, with the upgrade, authorization and stream as children.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("client.address", r.RemoteAddr),
+		))
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//nameSpan names the request span after the matched route, which is only known inside the router
+func nameSpan(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(r.Method + " " + template)
+				span.SetAttributes(attribute.String("http.route", template))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//sessionContext returns a context outliving r, as ws sessions need once the connection is hijacked,
+//that still carries r's span so the session's spans join its trace
+func sessionContext(r *http.Request) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(r.Context()))
+}
+
+//endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+//tracedConfig returns a copy of config whose API server requests, including the exec upgrade and with it
+//the dial to the kubelet, get client spans and carry the trace on to the API server. Without tracing it
+//returns config itself.
+func tracedConfig(config *rest.Config) *rest.Config {
+	if !tracingEnabled {
+		return config
+	}
+	traced := rest.CopyConfig(config)
+	traced.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return tracingTransport{rt}
+	})
+	return traced
+}
+
+type tracingTransport struct {
+	rt http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "kube-apiserver "+req.Method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("url.path", req.URL.Path),
+	))
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.rt.RoundTrip(req)
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if err == nil && resp.StatusCode >= http.StatusBadRequest {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	endSpan(span, err)
+	return resp, err
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+//responseGuard records whether a response has been started, so a handler can't
+//write an error and then still attempt the websocket upgrade
+type responseGuard struct {
+	http.ResponseWriter
+	written bool
+
+	//The hijacked connection, counting the bytes of the upgraded session on the wire
+	conn *countingConn
+}
+
+func (g *responseGuard) WriteHeader(code int) {
+	g.written = true
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *responseGuard) Write(data []byte) (int, error) {
+	g.written = true
+	return g.ResponseWriter.Write(data)
+}
+
+//Hijack exposes the underlying connection, which gorilla needs for the upgrade. Reads go through the
+//returned reader, so it is pointed at the counting connection too; gorilla refuses the upgrade anyway
+//when the reader holds buffered data.
+func (g *responseGuard) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := g.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil || brw.Reader.Buffered() > 0 {
+		return conn, brw, err
+	}
+	g.conn = &countingConn{Conn: conn}
+	brw.Reader.Reset(g.conn)
+	return g.conn, brw, nil
+}
+
+//countingConn counts the bytes a session reads and writes on the wire, compressed or not, once its
+//logger is set after the handshake
+type countingConn struct {
+	net.Conn
+	logger *sessionLogger
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.logger != nil {
+		atomic.AddInt64(&c.logger.wireIn, int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if c.logger != nil {
+		atomic.AddInt64(&c.logger.wireOut, int64(n))
+	}
+	return n, err
+}
+
+//offersDeflate reports whether the client of r offered permessage-deflate, which the upgrader accepts
+//with -compression
+func offersDeflate(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-Websocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//validateTarget checks the pod coordinates are present before anything is asked of the API server
+func validateTarget(namespace, podName string) error {
+	if len(namespace) == 0 {
+		return errors.New("namespace is required")
+	}
+	if len(podName) == 0 {
+		return errors.New("pod name is required")
+	}
+	return nil
+}
+
+//admitSession runs the checks shared by every ws endpoint before the upgrade, writing the
+//rejection itself. On success the returned func releases the reserved session slot.
+func (s *Server) admitSession(guard *responseGuard, r *http.Request) (func(), bool) {
+	if !s.checkOrigin(r) {
+		httpError(guard, http.StatusForbidden, "origin not allowed")
+		return nil, false
+	}
+	release, status, err := s.reserveSession(r)
+	if err != nil {
+		if status == http.StatusTooManyRequests {
+			guard.Header().Set("Retry-After", sessionRetryAfter)
+		}
+		httpError(guard, status, err.Error())
+		return nil, false
+	}
+	return release, true
+}
+
+//admitReattach runs the checks of admitSession for a client taking over a detachable session, which
+//already holds a session slot, writing the rejection itself
+func (s *Server) admitReattach(guard *responseGuard, r *http.Request) bool {
+	if !s.checkOrigin(r) {
+		httpError(guard, http.StatusForbidden, "origin not allowed")
+		return false
+	}
+	if draining, _ := s.sessions.status(); draining {
+		httpError(guard, http.StatusServiceUnavailable, "server draining")
+		return false
+	}
+	if err := s.upgradeLimits.allow(remoteIP(r), s.requestUser(r)); err != nil {
+		guard.Header().Set("Retry-After", sessionRetryAfter)
+		httpError(guard, http.StatusTooManyRequests, err.Error())
+		return false
+	}
+	return true
+}
+
+//reserveSession claims a session slot for the client of r within the upgrade rate and session limits,
+//returning the HTTP status to reject it with when it can't. The returned func releases the slot.
+func (s *Server) reserveSession(r *http.Request) (func(), int, error) {
+	if draining, _ := s.sessions.status(); draining {
+		return nil, http.StatusServiceUnavailable, errors.New("server draining")
+	}
+
+	ip, user := remoteIP(r), s.requestUser(r)
+	if err := s.upgradeLimits.allow(ip, user); err != nil {
+		return nil, http.StatusTooManyRequests, err
+	}
+	if err := s.sessions.reserve(ip, user); err != nil {
+		return nil, http.StatusTooManyRequests, err
+	}
+	return func() { s.sessions.release(ip, user) }, http.StatusOK, nil
+}
+
+const (
+	// Handshake response header carrying the session ID, to correlate client reports with the server logs.
+	sessionIDHeader = "X-Session-Id"
+
+	// Handshake response header carrying the token resuming the session after a lost connection.
+	resumeTokenHeader = "X-Resume-Token"
+)
+
+//upgradeWs upgrades the connection to ws for the session of logger, refusing when a pre-upgrade step
+//already wrote a response. header is added to the handshake response and may be nil.
+func (s *Server) upgradeWs(g *responseGuard, r *http.Request, logger *sessionLogger, header http.Header) (*websocket.Conn, error) {
+	if g.written {
+		return nil, errors.New("response already written before upgrade")
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set(sessionIDHeader, logger.id)
+
+	_, span := tracer.Start(r.Context(), "upgrade")
+	ws, err := s.upgrader.Upgrade(g, r, header)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	//Only used when the client negotiated permessage-deflate, validated at startup
+	ws.SetCompressionLevel(s.opts.CompressionLevel)
+	//Wire bytes are only worth comparing to the payload when they may be deflated. Nothing reads or
+	//writes the connection until the session starts, after this returns.
+	if s.upgrader.EnableCompression && offersDeflate(r) && g.conn != nil {
+		g.conn.logger = logger
+	}
+	return ws, nil
+}
+
+//readMessage reads the next message like ws.ReadMessage, but fails with websocket.ErrReadLimit once it
+//inflates past -max-message-size. The read limit only bounds compressed frames as they arrive, so a
+//small deflated frame could otherwise expand into megabytes.
+func (s *Server) readMessage(ws *websocket.Conn) (int, []byte, error) {
+	messageType, r, err := ws.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	message, err := io.ReadAll(io.LimitReader(r, s.opts.MaxMessageSize+1))
+	if err != nil {
+		return messageType, nil, err
+	}
+	if int64(len(message)) > s.opts.MaxMessageSize {
+		return messageType, nil, websocket.ErrReadLimit
+	}
+	return messageType, message, nil
+}
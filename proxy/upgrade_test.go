@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+//responseOrder records a handler both writing a response and hijacking the connection for an upgrade,
+//in either order. newTestServer checks every request with it.
+type responseOrder struct {
+	http.ResponseWriter
+	mu       sync.Mutex
+	wrote    bool
+	hijacked bool
+	err      error
+}
+
+//write records a response being written
+func (o *responseOrder) write() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.hijacked && o.err == nil {
+		o.err = errors.New("response written after the upgrade")
+	}
+	o.wrote = true
+}
+
+func (o *responseOrder) WriteHeader(code int) {
+	o.write()
+	o.ResponseWriter.WriteHeader(code)
+}
+
+func (o *responseOrder) Write(data []byte) (int, error) {
+	o.write()
+	return o.ResponseWriter.Write(data)
+}
+
+func (o *responseOrder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	o.mu.Lock()
+	if o.wrote && o.err == nil {
+		o.err = errors.New("upgrade attempted after a response was written")
+	}
+	o.hijacked = true
+	o.mu.Unlock()
+
+	h, ok := o.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	return h.Hijack()
+}
+
+func TestUpgradeWsRefusesWrittenResponse(t *testing.T) {
+	s, _ := newTestProxy(t, nil)
+	order := &responseOrder{ResponseWriter: httptest.NewRecorder()}
+	guard := &responseGuard{ResponseWriter: order}
+	httpError(guard, http.StatusBadRequest, "rejected")
+
+	//A valid handshake, which gorilla would go on to upgrade
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods/web-0/exec", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if _, err := s.upgradeWs(guard, r, &sessionLogger{id: "test"}, nil); err == nil {
+		t.Fatal("upgradeWs upgraded after the response was written")
+	}
+	if order.hijacked {
+		t.Fatal("upgradeWs hijacked the connection after the response was written")
+	}
+}
+
+//TestRejectedUpgrades runs requests rejected before the upgrade. newTestServer fails the test when any of
+//them writes the rejection and still attempts the upgrade, or the other way around.
+func TestRejectedUpgrades(t *testing.T) {
+	ts := newTestServer(t, func(o *Options) {
+		o.AllowedOrigins = "https://good.example"
+		o.MaxSessions = 1
+	})
+	for _, test := range []struct {
+		name   string
+		query  string
+		header http.Header
+		status int
+	}{
+		{"bad origin", "", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+		{"bad params", "&stdin-rate=fast", nil, http.StatusBadRequest},
+		{"detach disabled", "&detach=0123456789abcdef0123", nil, http.StatusBadRequest},
+	} {
+		_, resp, err := dialExec(ts, test.query, test.header)
+		if err == nil || resp == nil || resp.StatusCode != test.status {
+			t.Errorf("%s: got %v, want status %d", test.name, err, test.status)
+		}
+	}
+
+	//The session limit is checked once the request is valid
+	ws, _, err := dialExec(ts, "", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	_, resp, err := dialExec(ts, "", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("over -max-sessions: got %v, want status %d", err, http.StatusTooManyRequests)
+	}
+	if !errors.Is(err, websocket.ErrBadHandshake) {
+		t.Errorf("over -max-sessions: got %v, want the handshake refused", err)
+	}
+	echo(t, ws, "hello\n")
+}
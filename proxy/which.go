@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+//whichResponse is the JSON body returned by the which endpoint
+type whichResponse struct {
+	Found bool   `json:"found"`
+	Path  string `json:"path,omitempty"`
+}
+
+//serveWhich reports whether a command binary is present in the container by running `command -v` without a tty.
+//The lookup is admitted, checked and authorized like an exec session running it.
+func (s *Server) serveWhich(w http.ResponseWriter, r *http.Request) {
+	release, ok := s.admitSession(&responseGuard{ResponseWriter: w}, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	params := mux.Vars(r)
+	vals := r.URL.Query()
+	namespace := params["namespace"]
+	podName := params["podName"]
+	containerName := vals.Get("container")
+
+	cmd := vals.Get("cmd")
+	if len(cmd) == 0 {
+		httpError(w, http.StatusBadRequest, "missing cmd query parameter")
+		return
+	}
+
+	//The lookup runs in the container kubectl would pick, which is the one to check
+	if len(containerName) == 0 {
+		client, err := s.requestClient(r)
+		if err == nil {
+			containerName, err = defaultContainer(r.Context(), client, namespace, podName)
+		}
+		if err != nil {
+			httpError(w, statusForError(err), err.Error())
+			return
+		}
+	}
+
+	//Pass cmd as a positional argument so it is never interpreted by the shell
+	commands, err := s.execCommand([]string{"/bin/sh", "-c", `command -v "$1"`, "sh", cmd})
+	if err == nil {
+		err = s.policy.check(r.Context(), s.requestCluster(r).clientset, namespace, podName, containerName, commands)
+	}
+	if err == nil {
+		err = s.authorize(r, "which", namespace, podName, containerName, commands)
+	}
+	if err != nil {
+		httpError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	req := s.newExecRequest(s.requestCluster(r).clientset, namespace, podName, containerName, commands, false, false)
+
+	executor, err := s.newExecutor(s.requestConfig(r), s.opts.ExecMethod, req.URL())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), whichTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+
+	//command -v exits non-zero when the binary can't be found
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		writeJSON(w, http.StatusOK, whichResponse{Found: false})
+		return
+	}
+	if err != nil {
+		status := http.StatusBadGateway
+		if ctx.Err() == context.DeadlineExceeded {
+			status = http.StatusGatewayTimeout
+		} else if strings.Contains(err.Error(), "forbidden") {
+			status = http.StatusForbidden
+		}
+		httpError(w, status, err.Error())
+		return
+	}
+
+	path := strings.TrimSpace(stdout.String())
+	writeJSON(w, http.StatusOK, whichResponse{Found: len(path) != 0, Path: path})
+}